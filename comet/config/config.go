@@ -1,40 +1,86 @@
 package config
 
 import (
+	"compress/flate"
+	"errors"
 	"fmt"
+	"im/comet/zone"
+	"im/pkg/log"
+	inet "im/pkg/net"
 	"im/pkg/yaml"
+	"path"
+	"reflect"
 )
 
+const redacted = "******"
+
 type Config struct {
 	// base section
 	PidFile string "pidfile"
 	MaxProc int    "max_proc"
-	//Whitelist []string "white_list"
-	//WhiteLog  string   "white_log"
-	StatBind  yaml.Addresses "stat_bind"
-	PprofBind yaml.Addresses "pprof_bind"
+	NodeId  int    "node_id"
+	// seconds to wait sessions flush on shutdown
+	DrainTimeout int "drain_timeout"
+	// max connections of tcp and websocket, 0 unlimited
+	MaxConn int "max_conn"
+	// policy for a uid already online: kick, reject or allow
+	DupLogin string "dup_login"
+	// sessions traced to white_log, uids or key prefixes, empty white_log off
+	Whitelist []string "white_list"
+	WhiteLog  string   "white_log"
+	// bearer secret of the admin endpoints on stat_bind, empty none served
+	AdminSecret string "admin_secret"
+	// client ip access control at accept
+	Access struct {
+		Allow []string "allow"
+		Deny  []string "deny"
+		File  string   "file"
+	} "access"
+	// PROXY protocol sources trusted, cidr or ip
+	ProxyTrusted []string       "proxy_trusted"
+	StatBind     yaml.Addresses "stat_bind"
+	PprofBind    yaml.Addresses "pprof_bind"
 
 	// tcp
 	TCP struct {
-		Bind         yaml.Addresses "bind"
-		SndbufSize   int            "sndbuf_size"
-		RcvbufSize   int            "rcvbuf_size"
-		Keepalive    bool           "keepalive"
-		ReaderNum    int            "reader_num"
-		ReadbufNum   int            "readbuf_num"
-		ReadbufSize  int            "readbuf_size"
-		WriterNum    int            "writer_num"
-		WritebufNum  int            "writebuf_num"
-		WritebufSize int            "writebuf_size"
+		Bind          yaml.Addresses "bind"
+		SndbufSize    int            "sndbuf_size"
+		RcvbufSize    int            "rcvbuf_size"
+		Keepalive     bool           "keepalive"
+		ReusePort     bool           "reuseport"
+		ReaderNum     int            "reader_num"
+		ReadbufNum    int            "readbuf_num"
+		ReadbufSize   int            "readbuf_size"
+		WriterNum     int            "writer_num"
+		WritebufNum   int            "writebuf_num"
+		WritebufSize  int            "writebuf_size"
+		ProxyProtocol bool           "proxy_protocol"
+		TLSOpen       bool           "tls_open"
+		TLSBind       yaml.Addresses "tls_bind"
+		CertFile      string         "cert_file"
+		PrivateFile   string         "private_file"
 	} "tcp"
 
 	// websocket
 	Websocket struct {
-		Bind        yaml.Addresses "bind"
-		TLSOpen     bool           "tls_open"
-		TLSBind     yaml.Addresses "tls_bind"
-		CertFile    string         "cert_file"
-		PrivateFile string         "private_file"
+		Bind          yaml.Addresses "bind"
+		TLSOpen       bool           "tls_open"
+		TLSBind       yaml.Addresses "tls_bind"
+		CertFile      string         "cert_file"
+		PrivateFile   string         "private_file"
+		ProxyProtocol bool           "proxy_protocol"
+		// allowed origins, exact or wildcard, empty same host only
+		Origins          []string "origins"
+		Compression      bool     "compression"
+		CompressionLevel int      "compression_level"
+		MaxFrameSize     int64    "max_frame_size"
+		ReadBufferSize   int      "read_buffer_size"
+		WriteBufferSize  int      "write_buffer_size"
+		// http long polling next to /sub
+		Poll        bool "poll"
+		PollTimeout int  "poll_timeout"
+		// server-sent events next to /sub
+		SSE bool "sse"
 	} "websocket"
 
 	//// flash safe policy
@@ -42,12 +88,19 @@ type Config struct {
 	//FlashPolicyBind []string `:"flash:policy.bind:,"`
 	// proto section
 	Proto struct {
-		HandshakeTimeout int "handshake_timeout"
-		WriteTimeout     int "write_timeout"
-		SvrProto         int "svr_proto"
-		CliProto         int "cli_proto"
+		HandshakeTimeout int    "handshake_timeout"
+		WriteTimeout     int    "write_timeout"
+		Overflow         string "overflow"
+		SvrProto         int    "svr_proto"
+		CliProto         int    "cli_proto"
 	} "proto"
 
+	// auth
+	Auth struct {
+		Secret    string "secret"
+		Heartbeat int    "heartbeat"
+	} "auth"
+
 	// timer
 	Timer struct {
 		TimerNum  int "timer_num"
@@ -59,9 +112,14 @@ type Config struct {
 		CacheSize int "cache_size"
 	} "zone"
 
+	// push api
+	Push struct {
+		Bind          yaml.Addresses "bind"
+		Secret        string         "secret"
+		BroadcastRate int            "broadcast_rate"
+	} "push"
+
 	//EtcdAddr   yaml.Address "etcd_addr"
-	//// push
-	//RPCPushAddrs []string `:"push:rpc.addrs:,"`
 	//// logic
 	//LogicAddrs []string `:"logic:rpc.addrs:,"`
 	//// monitor
@@ -80,8 +138,120 @@ func (c *Config) Load(path string) error {
 	return yaml.Load(c, path)
 }
 
+// Print print the config, the secrets are redacted.
 func (c Config) Print() {
-	fmt.Printf("%v", c)
+	if c.Auth.Secret != "" {
+		c.Auth.Secret = redacted
+	}
+	if c.Push.Secret != "" {
+		c.Push.Secret = redacted
+	}
+	if c.AdminSecret != "" {
+		c.AdminSecret = redacted
+	}
+	fmt.Printf("%v\n", c)
+}
+
+// Validate check the config values.
+func (c *Config) Validate() error {
+	if c.NodeId < 0 || c.NodeId >= zone.MaxNode {
+		return fmt.Errorf("node_id must be in [0, %d)", zone.MaxNode)
+	}
+	if c.Zone.ZoneNum <= 0 || c.Zone.ZoneNum > zone.MaxZone {
+		return fmt.Errorf("zone.zone_num must be in [1, %d]", zone.MaxZone)
+	}
+	if c.Auth.Secret == "" {
+		return errors.New("auth.secret must be set")
+	}
+	if c.Proto.HandshakeTimeout <= 0 || c.Auth.Heartbeat <= 0 {
+		return errors.New("proto.handshake_timeout and auth.heartbeat must be positive")
+	}
+	if c.Proto.WriteTimeout < 0 {
+		return errors.New("proto.write_timeout must not be negative")
+	}
+	if _, err := zone.ParseOverflow(c.Proto.Overflow); err != nil {
+		return err
+	}
+	if c.MaxConn < 0 {
+		return errors.New("max_conn must not be negative")
+	}
+	if _, err := zone.ParseDupLogin(c.DupLogin); err != nil {
+		return err
+	}
+	for _, o := range c.Websocket.Origins {
+		if _, err := path.Match(o, ""); err != nil {
+			return fmt.Errorf("websocket.origins \"%s\" %v", o, err)
+		}
+	}
+	if c.Websocket.Compression && (c.Websocket.CompressionLevel < flate.HuffmanOnly || c.Websocket.CompressionLevel > flate.BestCompression) {
+		return fmt.Errorf("websocket.compression_level must be in [%d, %d]", flate.HuffmanOnly, flate.BestCompression)
+	}
+	if c.Websocket.MaxFrameSize < 0 || c.Websocket.ReadBufferSize < 0 || c.Websocket.WriteBufferSize < 0 {
+		return errors.New("websocket.max_frame_size and buffer sizes must not be negative")
+	}
+	if c.Websocket.Poll && (c.Websocket.PollTimeout <= 0 || c.Websocket.PollTimeout >= c.Auth.Heartbeat) {
+		return errors.New("websocket.poll_timeout must be positive and less than auth.heartbeat")
+	}
+	if c.TCP.ReusePort {
+		for _, a := range append(c.TCP.Bind, c.TCP.TLSBind...) {
+			if a.Unix != "" {
+				return fmt.Errorf("tcp.reuseport can't listen unix socket \"%s\"", a.Unix)
+			}
+		}
+	}
+	for _, key := range c.Whitelist {
+		if key == "" || key == "*" {
+			return errors.New("white_list must not have an empty or a bare \"*\" key")
+		}
+	}
+	if len(c.Push.Bind) > 0 && c.Push.Secret == "" {
+		return errors.New("push.secret must be set")
+	}
+	if c.Push.BroadcastRate < 0 {
+		return errors.New("push.broadcast_rate must not be negative")
+	}
+	if _, err := inet.ParseCIDRs(c.Access.Allow); err != nil {
+		return fmt.Errorf("access.allow %v", err)
+	}
+	if _, err := inet.ParseCIDRs(c.Access.Deny); err != nil {
+		return fmt.Errorf("access.deny %v", err)
+	}
+	if trusted, err := inet.ParseCIDRs(c.ProxyTrusted); err != nil {
+		return fmt.Errorf("proxy_trusted %v", err)
+	} else if len(trusted) == 0 && (c.TCP.ProxyProtocol || c.Websocket.ProxyProtocol) {
+		return errors.New("proxy_trusted must be set if tcp or websocket proxy_protocol is on")
+	}
+	if !log.ValidLevel(c.Log.Level) {
+		return fmt.Errorf("log.level \"%s\" not valid", c.Log.Level)
+	}
+	return nil
+}
+
+// RestartKeys return the keys changed in n which only take effect after a
+// restart, the others can be applied at runtime.
+func (c *Config) RestartKeys(n *Config) (keys []string) {
+	check := func(key string, o, n interface{}) {
+		if !reflect.DeepEqual(o, n) {
+			keys = append(keys, key)
+		}
+	}
+	check("pidfile", c.PidFile, n.PidFile)
+	check("max_proc", c.MaxProc, n.MaxProc)
+	check("node_id", c.NodeId, n.NodeId)
+	check("white_log", c.WhiteLog, n.WhiteLog)
+	check("admin_secret", c.AdminSecret, n.AdminSecret)
+	check("proxy_trusted", c.ProxyTrusted, n.ProxyTrusted)
+	check("tcp", c.TCP, n.TCP)
+	check("websocket", c.Websocket, n.Websocket)
+	check("proto.svr_proto", c.Proto.SvrProto, n.Proto.SvrProto)
+	check("proto.cli_proto", c.Proto.CliProto, n.Proto.CliProto)
+	check("auth.secret", c.Auth.Secret, n.Auth.Secret)
+	check("timer", c.Timer, n.Timer)
+	check("zone", c.Zone, n.Zone)
+	check("push", c.Push, n.Push)
+	check("log.dir", c.Log.Dir, n.Log.Dir)
+	check("log.buf_size", c.Log.BufSize, n.Log.BufSize)
+	return
 }
 
 //func NewConfig() *Config {
@@ -0,0 +1,144 @@
+package handle
+
+import (
+	"encoding/json"
+	"errors"
+	"im/comet/proto"
+	"im/comet/zone"
+	"im/pkg/log"
+	"runtime/debug"
+)
+
+var (
+	ErrNoSession = errors.New("context without session")
+)
+
+// Server is what a handle can do beyond its own session.
+type Server interface {
+	// Push push p to the session id.
+	Push(id uint64, p *proto.Proto) error
+	// Kick close the session id.
+	Kick(id uint64) error
+	// JoinRoom put the session into room, returns the members online.
+	JoinRoom(room string, s *zone.Session) (online int, e error)
+	// LeaveRoom remove the session from room.
+	LeaveRoom(room string, s *zone.Session) error
+}
+
+// Context of one client proto. Proto is modified in place into the reply,
+// which keeps the SeqId of the request.
+type Context struct {
+	Id      uint64
+	Session *zone.Session
+	Server  Server
+	Proto   *proto.Proto
+	Type    int16       // request type
+	Body    interface{} // decoded body registered in the Router
+
+	async   bool
+	replied bool
+}
+
+// NewContext new a context of the session, reset for every proto.
+func NewContext(s Server, session *zone.Session) *Context {
+	return &Context{Id: session.Id, Session: session, Server: s}
+}
+
+// Reset reset the context for the client proto p.
+func (c *Context) Reset(p *proto.Proto) {
+	c.Proto = p
+	c.Type = p.Type
+	c.Body = nil
+	c.async = false
+	c.replied = false
+}
+
+// Uid get the uid of the session.
+func (c *Context) Uid() uint32 {
+	return c.Session.Uid
+}
+
+// RemoteAddr get the client address.
+func (c *Context) RemoteAddr() string {
+	return c.Session.Addr
+}
+
+// Meta get the auth metadata of the session.
+func (c *Context) Meta(key string) string {
+	return c.Session.Meta[key]
+}
+
+// Reply set the reply type and json body, nil body replies without body.
+func (c *Context) Reply(typ int16, body interface{}) (e error) {
+	c.Proto.Type = typ
+	if body == nil {
+		c.Proto.Body = nil
+	} else if c.Proto.Body, e = json.Marshal(body); e != nil {
+		return
+	}
+	c.replied = true
+	return
+}
+
+// Error set a S2C_ERROR reply.
+func (c *Context) Error(code int, msg string) (e error) {
+	c.Proto.Type = c.Type
+	if e = ErrorReply(c.Proto, code, msg); e == nil {
+		c.replied = true
+	}
+	return
+}
+
+// Push push p to another session.
+func (c *Context) Push(id uint64, p *proto.Proto) error {
+	return c.Server.Push(id, p)
+}
+
+// Close close the session of the context.
+func (c *Context) Close() error {
+	if c.Session == nil {
+		return ErrNoSession
+	}
+	return c.Session.Kick()
+}
+
+// Async detach the handle from the read loop, fn runs in a new goroutine
+// with a copy of the context, the read loop goes on without a reply. The
+// reply set by Reply or Error in fn is pushed to the session, an error
+// returned by fn closes the session.
+func (c *Context) Async(fn func(c *Context) error) {
+	var (
+		ac = *c
+		p  = *c.Proto
+	)
+	// the body is in the read buffer, reused by the next proto
+	p.Body = append([]byte(nil), c.Proto.Body...)
+	ac.Proto = &p
+	ac.replied = false
+	c.async = true
+	go func() {
+		var e error
+		defer func() {
+			if r := recover(); r != nil {
+				log.Error("id: %v async handle type: %d panic(%v)\n%s", ac.Id, ac.Type, r, debug.Stack())
+				e = ac.Error(proto.ERR_INTERNAL, "internal error")
+			}
+			if e != nil {
+				log.Error("id: %v async handle type: %d error(%v)", ac.Id, ac.Type, e)
+				ac.Close()
+				return
+			}
+			if ac.replied {
+				if e = ac.Session.Push(ac.Proto); e != nil {
+					log.Error("id: %v async reply type: %d error(%v)", ac.Id, ac.Type, e)
+				}
+			}
+		}()
+		e = fn(&ac)
+	}()
+}
+
+// IsAsync report the handle went async, there is no reply in Proto.
+func (c *Context) IsAsync() bool {
+	return c.async
+}
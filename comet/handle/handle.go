@@ -4,13 +4,17 @@ import (
 	"im/comet/proto"
 )
 
-type Handle func(id uint64, p *proto.Proto) (e error)
+// Handle handle a client proto, see Context for the reply.
+type Handle func(c *Context) (e error)
 
-var Handles []Handle
-
-func init() {
-	Handles = make([]Handle, proto.C2S_MAX, proto.C2S_MAX)
-	Handles[proto.C2S_RC] = handle_rc
-	Handles[proto.C2S_HEART_BEAT] = handle_heartbeat
-	Handles[proto.C2S_CALCULATE] = handle_calculate
+// NewDefaultRouter new a router of the built-in client protos, wrapped by m.
+func NewDefaultRouter(m ...Middleware) *Router {
+	r := NewRouter()
+	r.Use(m...)
+	r.Register(proto.C2S_RC, proto.RC{}, handle_rc)
+	r.Register(proto.C2S_HEART_BEAT, proto.HeartBeat{}, handle_heartbeat)
+	r.Register(proto.C2S_CALCULATE, proto.Calculate{}, handle_calculate)
+	r.Register(proto.C2S_ROOM_JOIN, proto.Room{}, handle_room_join)
+	r.Register(proto.C2S_ROOM_LEAVE, proto.Room{}, handle_room_leave)
+	return r
 }
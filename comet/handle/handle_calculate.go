@@ -0,0 +1,9 @@
+package handle
+
+import (
+	"im/comet/proto"
+)
+
+func handle_calculate(c *Context) (e error) {
+	return c.Reply(proto.S2C_CALCULATE, c.Body.(*proto.Calculate))
+}
@@ -1,20 +1,12 @@
 package handle
 
 import (
-	"fmt"
 	"im/comet/proto"
-	"encoding/json"
+	"im/pkg/log"
 )
 
-func handle_rc(id uint64, p *proto.Proto) (e error) {
-	rc := &proto.RC{}
-	if e = json.Unmarshal([]byte(p.Body), &rc); e != nil {
-		return
-	}
-	
-	fmt.Printf("id %v, rc = %v\n", id, rc)
-	p.Body = nil
-	p.Type = proto.C2S_RC
-
-	return nil
+func handle_rc(c *Context) (e error) {
+	rc := c.Body.(*proto.RC)
+	log.Debug("id %v, rc = %v\n", c.Id, rc)
+	return c.Reply(proto.S2C_RC, nil)
 }
@@ -0,0 +1,29 @@
+package handle
+
+import (
+	"im/comet/proto"
+	"im/comet/zone"
+)
+
+func handle_room_join(c *Context) (e error) {
+	room := c.Body.(*proto.Room)
+	online, e := c.Server.JoinRoom(room.Room, c.Session)
+	switch e {
+	case nil:
+		return c.Reply(proto.S2C_ROOM_JOIN, &proto.RoomReply{Room: room.Room, Online: online})
+	case zone.ErrRoomId:
+		return c.Error(proto.ERR_BAD_BODY, e.Error())
+	case zone.ErrRoomLimit, zone.ErrSessionClosed:
+		return c.Error(proto.ERR_DENIED, e.Error())
+	}
+	return
+}
+
+func handle_room_leave(c *Context) (e error) {
+	room := c.Body.(*proto.Room)
+	// leaving a room not joined is not an error
+	if e = c.Server.LeaveRoom(room.Room, c.Session); e != nil && e != zone.ErrRoomNotFound {
+		return
+	}
+	return c.Reply(proto.S2C_ROOM_LEAVE, &proto.RoomReply{Room: room.Room})
+}
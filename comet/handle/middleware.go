@@ -0,0 +1,56 @@
+package handle
+
+import (
+	"fmt"
+	"im/comet/proto"
+	"im/comet/stat"
+	"im/pkg/log"
+	"runtime/debug"
+	"time"
+)
+
+// Logging log every handled proto.
+func Logging(typ int16, next Handle) Handle {
+	return func(c *Context) (e error) {
+		start := time.Now()
+		e = next(c)
+		log.Debug("id: %v handle type: %d seq: %d reply: %d async: %t cost: %v error(%v)", c.Id, typ, c.Proto.SeqId, c.Proto.Type, c.IsAsync(), time.Since(start), e)
+		return
+	}
+}
+
+// Recover turn a panic of the handle into a ERR_INTERNAL reply.
+func Recover(typ int16, next Handle) Handle {
+	return func(c *Context) (e error) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Error("id: %v handle type: %d panic(%v)\n%s", c.Id, typ, r, debug.Stack())
+				e = c.Error(proto.ERR_INTERNAL, "internal error")
+			}
+		}()
+		return next(c)
+	}
+}
+
+// Metrics count handled protos per type into stat.HStat.
+func Metrics(typ int16, next Handle) Handle {
+	return func(c *Context) (e error) {
+		start := time.Now()
+		e = next(c)
+		stat.HStat.Incr(typ, time.Since(start), e != nil || c.Proto.Type == proto.S2C_ERROR)
+		return
+	}
+}
+
+// Authorize reject the proto with a ERR_DENIED reply if allow returns false.
+func Authorize(allow func(c *Context) bool) Middleware {
+	return func(typ int16, next Handle) Handle {
+		return func(c *Context) (e error) {
+			if !allow(c) {
+				log.Warn("id: %v handle type: %d denied", c.Id, typ)
+				return c.Error(proto.ERR_DENIED, fmt.Sprintf("type %d denied", typ))
+			}
+			return next(c)
+		}
+	}
+}
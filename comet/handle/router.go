@@ -0,0 +1,89 @@
+package handle
+
+import (
+	"encoding/json"
+	"im/comet/proto"
+	"im/pkg/log"
+	"reflect"
+	"sync"
+)
+
+// Middleware wrap the handle of message type typ.
+type Middleware func(typ int16, next Handle) Handle
+
+type route struct {
+	body   reflect.Type // nil means no body
+	handle Handle
+}
+
+// Router dispatch client protos to the handle registered by message type.
+type Router struct {
+	lock        sync.RWMutex
+	routes      map[int16]*route
+	middlewares []Middleware
+}
+
+// NewRouter new a router.
+func NewRouter() *Router {
+	return &Router{routes: make(map[int16]*route)}
+}
+
+// Use append middlewares, the first one is the outermost. it only affects
+// handles registered later.
+func (r *Router) Use(m ...Middleware) {
+	r.lock.Lock()
+	r.middlewares = append(r.middlewares, m...)
+	r.lock.Unlock()
+}
+
+// Register register the handle of message type typ. body is a value of the
+// body type, the proto body is json decoded into a new one and set as a
+// pointer in Context.Body, nil body sets nil.
+func (r *Router) Register(typ int16, body interface{}, h Handle) {
+	var rt = &route{}
+	if body != nil {
+		rt.body = reflect.TypeOf(body)
+	}
+	r.lock.Lock()
+	for i := len(r.middlewares) - 1; i >= 0; i-- {
+		h = r.middlewares[i](typ, h)
+	}
+	rt.handle = h
+	r.routes[typ] = rt
+	r.lock.Unlock()
+}
+
+// Handle handle the client proto of the context and turn it into the reply.
+// unknown type and undecodable body get a S2C_ERROR reply, a handle error
+// should close the connection.
+func (r *Router) Handle(c *Context) (e error) {
+	var (
+		rt *route
+		ok bool
+		p  = c.Proto
+	)
+	r.lock.RLock()
+	rt, ok = r.routes[c.Type]
+	r.lock.RUnlock()
+	if !ok {
+		log.Warn("id: %v unknown proto type %d", c.Id, c.Type)
+		return c.Error(proto.ERR_UNKNOWN_TYPE, "unknown type")
+	}
+	if rt.body != nil {
+		v := reflect.New(rt.body)
+		if e = json.Unmarshal(p.Body, v.Interface()); e != nil {
+			log.Warn("id: %v proto type %d body unmarshal error(%v)", c.Id, c.Type, e)
+			return c.Error(proto.ERR_BAD_BODY, "bad body")
+		}
+		c.Body = v.Interface()
+	}
+	return rt.handle(c)
+}
+
+// ErrorReply turn p into a S2C_ERROR reply, the SeqId is kept.
+func ErrorReply(p *proto.Proto, code int, msg string) (e error) {
+	reply := proto.Error{Code: code, Msg: msg, Type: p.Type}
+	p.Type = proto.S2C_ERROR
+	p.Body, e = json.Marshal(&reply)
+	return
+}
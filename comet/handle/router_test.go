@@ -0,0 +1,92 @@
+package handle
+
+import (
+	"encoding/json"
+	"im/comet/proto"
+	"im/comet/zone"
+	"testing"
+)
+
+type testServer struct{}
+
+func (testServer) Push(id uint64, p *proto.Proto) error               { return nil }
+func (testServer) Kick(id uint64) error                               { return nil }
+func (testServer) JoinRoom(room string, s *zone.Session) (int, error) { return 1, nil }
+func (testServer) LeaveRoom(room string, s *zone.Session) error       { return nil }
+
+func testContext(p *proto.Proto) *Context {
+	c := NewContext(testServer{}, zone.NewSession(1, 0, 1, 1))
+	c.Reset(p)
+	return c
+}
+
+func TestRouter(t *testing.T) {
+	var (
+		e     error
+		c     *Context
+		reply proto.Error
+		order []string
+		r     = NewRouter()
+	)
+	mark := func(name string) Middleware {
+		return func(typ int16, next Handle) Handle {
+			return func(c *Context) error {
+				order = append(order, name)
+				return next(c)
+			}
+		}
+	}
+	r.Use(Recover, mark("a"), mark("b"))
+	r.Register(proto.C2S_RC, proto.RC{}, func(c *Context) error {
+		if c.Body.(*proto.RC).Uid != 1 {
+			t.Fatalf("body %v", c.Body)
+		}
+		return c.Reply(proto.S2C_RC, nil)
+	})
+	r.Register(proto.C2S_CALCULATE, nil, func(c *Context) error {
+		panic("calculate")
+	})
+
+	c = testContext(&proto.Proto{Type: proto.C2S_RC, SeqId: 7, Body: []byte(`{"uid":1}`)})
+	if e = r.Handle(c); e != nil || c.Proto.Type != proto.S2C_RC || c.Proto.SeqId != 7 {
+		t.Fatalf("handle rc %v error(%v)", c.Proto, e)
+	}
+	if len(order) != 2 || order[0] != "a" || order[1] != "b" {
+		t.Fatalf("middleware order %v", order)
+	}
+
+	c = testContext(&proto.Proto{Type: proto.C2S_MAX})
+	if e = r.Handle(c); e != nil || c.Proto.Type != proto.S2C_ERROR {
+		t.Fatalf("unknown type %v error(%v)", c.Proto, e)
+	}
+	if json.Unmarshal(c.Proto.Body, &reply); reply.Code != proto.ERR_UNKNOWN_TYPE || reply.Type != proto.C2S_MAX {
+		t.Fatalf("unknown type reply %v", reply)
+	}
+
+	c = testContext(&proto.Proto{Type: proto.C2S_RC, Body: []byte(`x`)})
+	if e = r.Handle(c); e != nil || c.Proto.Type != proto.S2C_ERROR {
+		t.Fatalf("bad body %v error(%v)", c.Proto, e)
+	}
+
+	c = testContext(&proto.Proto{Type: proto.C2S_CALCULATE})
+	if e = r.Handle(c); e != nil || c.Proto.Type != proto.S2C_ERROR {
+		t.Fatalf("panic %v error(%v)", c.Proto, e)
+	}
+	if json.Unmarshal(c.Proto.Body, &reply); reply.Code != proto.ERR_INTERNAL || reply.Type != proto.C2S_CALCULATE {
+		t.Fatalf("panic reply %v", reply)
+	}
+}
+
+func TestContextAsync(t *testing.T) {
+	c := testContext(&proto.Proto{Type: proto.C2S_RC, SeqId: 9, Body: []byte(`{"uid":1}`)})
+	c.Async(func(c *Context) error {
+		return c.Reply(proto.S2C_RC, map[string]int{"uid": 1})
+	})
+	if !c.IsAsync() {
+		t.FailNow()
+	}
+	p := c.Session.Ready()
+	if p.Type != proto.S2C_RC || p.SeqId != 9 || string(p.Body) != `{"uid":1}` {
+		t.Fatalf("async reply %v", p)
+	}
+}
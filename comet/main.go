@@ -6,6 +6,8 @@ import (
 	"im/comet/server"
 	"im/comet/utils"
 	"im/comet/zone"
+	"im/pkg/log"
+	inet "im/pkg/net"
 	"im/pkg/pprof"
 	"os"
 	"os/signal"
@@ -16,17 +18,40 @@ import (
 	"im/comet/stat"
 )
 
-var Conf *config.Config = nil
+const confPath = "./comet-config.yaml"
+
+var (
+	Conf *config.Config = nil
+	Auth *server.HMACAuth
+)
 
 func main() {
 	Conf = &config.Config{}
-	if e := Conf.Load("./comet-config.yaml"); e != nil {
+	if e := Conf.Load(confPath); e != nil {
 		fmt.Printf("config init error %v\n", e)
 		return
 	}
 
 	Conf.Print()
 
+	if e := Conf.Validate(); e != nil {
+		fmt.Printf("config invalid %v\n", e)
+		return
+	}
+	log.SetLevel(Conf.Log.Level)
+
+	// validated
+	overflow, _ := zone.ParseOverflow(Conf.Proto.Overflow)
+	dupLogin, _ := zone.ParseDupLogin(Conf.DupLogin)
+	trusted, _ := inet.ParseCIDRs(Conf.ProxyTrusted)
+	allow, _ := inet.ParseCIDRs(Conf.Access.Allow)
+	deny, _ := inet.ParseCIDRs(Conf.Access.Deny)
+	access, e := server.NewAccessControl(allow, deny, Conf.Access.File)
+	if e != nil {
+		fmt.Printf("access control init error %v\n", e)
+		return
+	}
+
 	// set max routine
 	runtime.GOMAXPROCS(Conf.MaxProc)
 
@@ -37,6 +62,7 @@ func main() {
 			CacheSize: Conf.Zone.CacheSize,
 		})
 	}
+	Auth = server.NewHMACAuth(Conf.Auth.Secret, time.Duration(Conf.Auth.Heartbeat)*time.Second)
 	round := utils.NewRound(utils.RoundOptions{
 		ReaderNum:    Conf.TCP.ReaderNum,
 		ReadbufNum:   Conf.TCP.ReadbufNum,
@@ -47,16 +73,56 @@ func main() {
 		TimerNum:     Conf.Timer.TimerNum,
 		TimerSize:    Conf.Timer.TimerSize,
 	})
-	server.DefaultServer = server.NewServer(zones, round, []handle.Handle{}, server.ServerOptions{
+	router := handle.NewDefaultRouter(handle.Recover, handle.Logging, handle.Metrics)
+	server.DefaultServer = server.NewServer(zones, round, router, server.ServerOptions{
+		NodeId:           Conf.NodeId,
 		CliProto:         Conf.Proto.CliProto,
 		SvrProto:         Conf.Proto.SvrProto,
-		HandshakeTimeout: time.Duration(Conf.Proto.HandshakeTimeout),
+		HandshakeTimeout: time.Duration(Conf.Proto.HandshakeTimeout) * time.Second,
+		WriteTimeout:     time.Duration(Conf.Proto.WriteTimeout) * time.Second,
+		Overflow:         overflow,
+		DupLogin:         dupLogin,
 		TCPKeepalive:     Conf.TCP.Keepalive,
 		TCPRcvbufSize:    Conf.TCP.RcvbufSize,
 		TCPSndbufSize:    Conf.TCP.SndbufSize,
+		TCPReusePort:     Conf.TCP.ReusePort,
+		MaxConn:          Conf.MaxConn,
+		ProxyTCP:         Conf.TCP.ProxyProtocol,
+		ProxyWebsocket:   Conf.Websocket.ProxyProtocol,
+		ProxyTrusted:     trusted,
+		Authenticator:    Auth,
+		Access:           access,
+		Websocket: server.WebsocketOptions{
+			Origins:          Conf.Websocket.Origins,
+			Compression:      Conf.Websocket.Compression,
+			CompressionLevel: Conf.Websocket.CompressionLevel,
+			MaxFrameSize:     Conf.Websocket.MaxFrameSize,
+			ReadBufferSize:   Conf.Websocket.ReadBufferSize,
+			WriteBufferSize:  Conf.Websocket.WriteBufferSize,
+			Poll:             Conf.Websocket.Poll,
+			PollTimeout:      time.Duration(Conf.Websocket.PollTimeout) * time.Second,
+			SSE:              Conf.Websocket.SSE,
+		},
 	})
 
-	// white list TODO
+	// white list
+	if Conf.WhiteLog != "" {
+		w, e := server.NewWhitelist(Conf.WhiteLog, Conf.Whitelist)
+		if e != nil {
+			panic(e)
+		}
+		server.DefaultWhitelist = w
+		if Conf.AdminSecret != "" {
+			stat.Handle("/admin/whitelist", w.Handler(Conf.AdminSecret))
+		}
+	}
+
+	// listeners passed by the old process on SIGUSR2
+	if n, e := inet.Inherit(); e != nil {
+		panic(e)
+	} else if n > 0 {
+		log.Info("inherit %d listeners from the parent process", n)
+	}
 
 	pprof.Init(Conf.PprofBind.StringSlice())
 	stat.StartStats(Conf.StatBind.StringSlice(), Conf.Zone.ZoneNum)
@@ -66,6 +132,13 @@ func main() {
 		panic(e)
 	}
 
+	// tcp tls comet
+	if Conf.TCP.TLSOpen {
+		if e := server.InitTCPWithTLS(Conf.TCP.TLSBind.StringSlice(), Conf.MaxProc, Conf.TCP.CertFile, Conf.TCP.PrivateFile); e != nil {
+			panic(e)
+		}
+	}
+
 	// websocket comet
 	if e := server.InitWebsocket(Conf.Websocket.Bind.StringSlice()); e != nil {
 		panic(e)
@@ -78,17 +151,45 @@ func main() {
 		}
 	}
 
+	// push api
+	if len(Conf.Push.Bind) > 0 {
+		if e := server.InitPush(Conf.Push.Bind.StringSlice(), Conf.Push.Secret, Conf.Push.BroadcastRate); e != nil {
+			panic(e)
+		}
+	}
+
+	inet.CloseInherited()
+	// the parent of SIGUSR2 drains from now on
+	if e := inet.Ready(); e != nil {
+		log.Error("inet.Ready() error(%v)", e)
+	}
+
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT, syscall.SIGSTOP)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT, syscall.SIGSTOP, syscall.SIGUSR2)
 	for {
 		s := <-c
 		fmt.Printf("get a signal %s", s.String())
 		switch s {
 		case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGSTOP, syscall.SIGINT:
+			if !server.DefaultServer.Shutdown(time.Duration(Conf.DrainTimeout) * time.Second) {
+				fmt.Printf("shutdown drain timeout, %d seconds\n", Conf.DrainTimeout)
+			}
 			return
 		case syscall.SIGHUP:
-			// TODO reload
-			//return
+			reload()
+		case syscall.SIGUSR2:
+			// hand the listeners off to a new binary, then drain once it
+			// serves, keep serving if it failed
+			p, e := inet.StartProcess()
+			if e != nil {
+				log.Error("inet.StartProcess() error(%v)", e)
+				continue
+			}
+			log.Info("new process %d ready, draining", p.Pid)
+			if !server.DefaultServer.Shutdown(time.Duration(Conf.DrainTimeout) * time.Second) {
+				fmt.Printf("shutdown drain timeout, %d seconds\n", Conf.DrainTimeout)
+			}
+			return
 		default:
 			return
 		}
@@ -32,11 +32,17 @@ const (
 	SeqIdOffset = TypeOffset + TypeSize
 )
 
+// websocket subprotocol, every binary frame is a proto in the tcp wire format
+const (
+	WebsocketBinary = "comet.binary.v1"
+)
+
 var (
 	emptyProto    = Proto{}
 	emptyJSONBody = []byte("{}")
 
-	ErrProtoPackLen = errors.New("default server codec pack length error")
+	ErrProtoPackLen   = errors.New("default server codec pack length error")
+	ErrProtoFrameType = errors.New("websocket frame type error")
 )
 
 var (
@@ -118,11 +124,11 @@ func (p *Proto) WriteTCP(wr *bufio.Writer) (e error) {
 		packLen int32
 	)
 
-	//if p.Operation == define.OP_RAW {
-	//	// write without buffer, job concact proto into raw buffer
-	//	_, e = wr.WriteRaw(p.Body)
-	//	return
-	//}
+	if p.Type == PROTO_RAW {
+		// write without buffer, pusher concact protos into raw body
+		_, e = wr.WriteRaw(p.Body)
+		return
+	}
 	packLen = RawHeaderSize + int32(len(p.Body))
 	if buf, e = wr.Peek(RawHeaderSize); e != nil {
 		return
@@ -142,34 +148,63 @@ func (p *Proto) ReadWebsocket(wr *websocket.Conn) (e error) {
 	return wr.ReadJSON(p)
 }
 
-func (p *Proto) WriteBodyTo(b *bytes.Writer) (e error) {
+// NewRaw encode ps once into a raw proto, pushed to many sessions it is
+// written as one batch, see PROTO_RAW.
+func NewRaw(ps ...*Proto) *Proto {
+	var n int
+	for _, p := range ps {
+		n += RawHeaderSize + len(p.Body)
+	}
+	b := bytes.NewWriterSize(n)
+	for _, p := range ps {
+		p.WriteTo(b)
+	}
+	return &Proto{Type: PROTO_RAW, Body: b.Buffer()}
+}
+
+// RawProtos split the body of a raw proto into the protos, the bodies share
+// the raw body.
+func (p *Proto) RawProtos() (ps []Proto) {
 	var (
-		ph  Proto
-		js  []json.RawMessage
-		j   json.RawMessage
-		jb  []byte
-		bts []byte
+		ph     Proto
+		offset int32
+		buf    = p.Body
 	)
-	offset := int32(PackOffset)
-	buf := p.Body[:]
 	for {
 		if (len(buf[offset:])) < RawHeaderSize {
+			break
+		}
+		packLen := binary.BigEndian.Int32(buf[offset : offset+PackSize])
+		if packLen < RawHeaderSize || int(offset+packLen) > len(buf) {
 			// should not be here
 			break
 		}
-		packLen := binary.BigEndian.Int32(buf[offset:PackSize])
 		packBuf := buf[offset : offset+packLen]
 		// packet
 		ph.Ver = binary.BigEndian.Int8(packBuf[VerOffset:TypeOffset])
 		ph.Type = binary.BigEndian.Int16(packBuf[TypeOffset:SeqIdOffset])
 		ph.SeqId = binary.BigEndian.Int32(packBuf[SeqIdOffset:RawHeaderSize])
 		ph.Body = packBuf[RawHeaderSize:]
+		ps = append(ps, ph)
+		offset += packLen
+	}
+	return
+}
+
+func (p *Proto) WriteBodyTo(b *bytes.Writer) (e error) {
+	var (
+		js  []json.RawMessage
+		jb  []byte
+		bts []byte
+	)
+	for _, ph := range p.RawProtos() {
+		if len(ph.Body) == 0 {
+			ph.Body = emptyJSONBody
+		}
 		if jb, e = json.Marshal(&ph); e != nil {
 			return
 		}
-		j = json.RawMessage(jb)
-		js = append(js, j)
-		offset += packLen
+		js = append(js, json.RawMessage(jb))
 	}
 	if bts, e = json.Marshal(js); e != nil {
 		return
@@ -183,14 +218,57 @@ func (p *Proto) WriteWebsocket(wr *websocket.Conn) (e error) {
 		p.Body = emptyJSONBody
 	}
 	// [{"ver":1,"op":8,"seq":1,"body":{}}, {"ver":1,"op":3,"seq":2,"body":{}}]
-	//if p.Operation == define.OP_RAW {
-	//	// batch mod
-	//	var b = bytes.NewWriterSize(len(p.Body) + 40*RawHeaderSize)
-	//	if e = p.WriteBodyTo(b); e != nil {
-	//		return
-	//	}
-	//	return wr.WriteMessage(websocket.TextMessage, b.Buffer())
-	//}
+	if p.Type == PROTO_RAW {
+		// batch mod
+		var b = bytes.NewWriterSize(len(p.Body) + 40*RawHeaderSize)
+		if e = p.WriteBodyTo(b); e != nil {
+			return
+		}
+		return wr.WriteMessage(websocket.TextMessage, b.Buffer())
+	}
 
 	return wr.WriteJSON([]*Proto{p})
 }
+
+// ReadWebsocketBinary read a binary frame in the tcp wire format, negotiated
+// by the WebsocketBinary subprotocol.
+func (p *Proto) ReadWebsocketBinary(wr *websocket.Conn) (e error) {
+	var (
+		typ     int
+		packLen int32
+		buf     []byte
+	)
+	if typ, buf, e = wr.ReadMessage(); e != nil {
+		return
+	}
+	if typ != websocket.BinaryMessage {
+		return ErrProtoFrameType
+	}
+	if len(buf) < RawHeaderSize {
+		return ErrProtoPackLen
+	}
+	packLen = binary.BigEndian.Int32(buf[PackOffset:XOffset])
+	if packLen > MaxPackSize || packLen != int32(len(buf)) {
+		return ErrProtoPackLen
+	}
+	p.Ver = binary.BigEndian.Int8(buf[VerOffset:TypeOffset])
+	p.Type = binary.BigEndian.Int16(buf[TypeOffset:SeqIdOffset])
+	p.SeqId = binary.BigEndian.Int32(buf[SeqIdOffset:])
+	if len(buf) > RawHeaderSize {
+		p.Body = buf[RawHeaderSize:]
+	} else {
+		p.Body = nil
+	}
+	return
+}
+
+// WriteWebsocketBinary write p as a binary frame in the tcp wire format, a
+// raw proto is one frame of its protos back to back.
+func (p *Proto) WriteWebsocketBinary(wr *websocket.Conn) (e error) {
+	if p.Type == PROTO_RAW {
+		return wr.WriteMessage(websocket.BinaryMessage, p.Body)
+	}
+	b := bytes.NewWriterSize(RawHeaderSize + len(p.Body))
+	p.WriteTo(b)
+	return wr.WriteMessage(websocket.BinaryMessage, b.Buffer())
+}
@@ -3,6 +3,7 @@ package proto
 const (
 	PROTO_READY  = 2048
 	PROTO_FINISH = 2049
+	PROTO_RAW    = 2050 // body is protos in the tcp wire format, see NewRaw
 )
 
 const (
@@ -10,6 +11,8 @@ const (
 	C2S_HEART_BEAT
 	C2S_AUTH
 	C2S_CALCULATE
+	C2S_ROOM_JOIN
+	C2S_ROOM_LEAVE
 	C2S_MAX
 )
 
@@ -19,12 +22,63 @@ const (
 	S2C_HEART_BEAT = S2C_BASE + C2S_HEART_BEAT
 	S2C_AUTH       = S2C_BASE + C2S_AUTH
 	S2C_CALCULATE  = S2C_BASE + C2S_CALCULATE
+	S2C_ROOM_JOIN  = S2C_BASE + C2S_ROOM_JOIN
+	S2C_ROOM_LEAVE = S2C_BASE + C2S_ROOM_LEAVE
 	S2C_MAX
 )
 
+// auth reply code
+const (
+	AUTH_OK = iota
+	AUTH_INVALID
+	AUTH_EXPIRED
+	AUTH_DENIED
+	AUTH_DUPLICATE // already online, see server dup_login
+)
+
+// server notice, not a reply of any client request
+const (
+	S2C_NOTICE_BASE = 1536
+	S2C_RECONNECT   = S2C_NOTICE_BASE + iota // server going down, reconnect another comet
+	S2C_ERROR                                // client request failed, see Error
+	S2C_KICKED                               // session closed by the server, see Kicked
+)
+
+// kicked reason code
+const (
+	KICK_DUP_LOGIN = iota + 1 // same user logged in again
+)
+
+// error reply code
+const (
+	ERR_UNKNOWN_TYPE = iota + 1
+	ERR_BAD_BODY
+	ERR_DENIED
+	ERR_INTERNAL
+)
+
 type Auth struct {
-	Uid  uint32  `json:"uid"`
-	Code string  `json:"code"`
+	Uid      uint32 `json:"uid"`
+	Code     string `json:"code"`
+	Device   string `json:"device,omitempty"`   // device id, unique per user
+	Platform string `json:"platform,omitempty"` // e.g. ios, android, web
+}
+
+type AuthReply struct {
+	Code  int    `json:"code"`
+	Msg   string `json:"msg,omitempty"`
+	Token string `json:"token,omitempty"` // long polling session token
+}
+
+type Kicked struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg,omitempty"`
+}
+
+type Error struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg,omitempty"`
+	Type int16  `json:"type"` // request type
 }
 
 type HeartBeat struct {
@@ -41,3 +95,12 @@ type RC struct {
 type Calculate struct {
 	Data []byte `json:"data"`
 }
+
+type Room struct {
+	Room string `json:"room"`
+}
+
+type RoomReply struct {
+	Room   string `json:"room"`
+	Online int    `json:"online,omitempty"` // members after join
+}
@@ -0,0 +1,45 @@
+package proto
+
+import (
+	gobytes "bytes"
+	"encoding/json"
+	"im/pkg/bufio"
+	"im/pkg/bytes"
+	"testing"
+)
+
+func TestRaw(t *testing.T) {
+	raw := NewRaw(&Proto{Ver: 1, Type: S2C_RC, SeqId: 1, Body: []byte(`{"a":1}`)}, &Proto{Ver: 1, Type: S2C_RC, SeqId: 2})
+
+	// tcp: the body is written as is, and read back as the protos
+	var (
+		p   Proto
+		buf gobytes.Buffer
+		wr  = bufio.NewWriter(&buf)
+	)
+	if err := raw.WriteTCP(wr); err != nil {
+		t.Fatal(err)
+	}
+	wr.Flush()
+	rr := bufio.NewReader(&buf)
+	for seq := int32(1); seq <= 2; seq++ {
+		if err := p.ReadTCP(rr); err != nil || p.SeqId != seq {
+			t.Fatalf("tcp proto %v error(%v)", p, err)
+		}
+	}
+
+	// websocket: one json array
+	var (
+		ps []Proto
+		b  = bytes.NewWriterSize(64)
+	)
+	if err := raw.WriteBodyTo(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b.Buffer(), &ps); err != nil {
+		t.Fatalf("json %s error(%v)", b.Buffer(), err)
+	}
+	if len(ps) != 2 || ps[0].SeqId != 1 || string(ps[0].Body) != `{"a":1}` || ps[1].SeqId != 2 {
+		t.Fatalf("json protos %+v", ps)
+	}
+}
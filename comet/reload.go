@@ -0,0 +1,96 @@
+package main
+
+import (
+	"im/comet/config"
+	"im/comet/server"
+	"im/comet/stat"
+	"im/comet/zone"
+	"im/pkg/log"
+	inet "im/pkg/net"
+	"im/pkg/pprof"
+	"reflect"
+	"time"
+)
+
+// reload re-read the config file and apply the runtime settings, the
+// settings need a restart are kept and reported.
+func reload() {
+	n := &config.Config{}
+	if e := n.Load(confPath); e != nil {
+		log.Error("reload config load %s error(%v)", confPath, e)
+		return
+	}
+	if e := n.Validate(); e != nil {
+		log.Error("reload config invalid error(%v), nothing applied", e)
+		return
+	}
+	for _, key := range Conf.RestartKeys(n) {
+		log.Warn("reload config %s changed, need restart to apply", key)
+	}
+
+	// runtime settings
+	if Conf.Log.Level != n.Log.Level {
+		log.SetLevel(n.Log.Level)
+		log.Info("reload log.level %s -> %s", Conf.Log.Level, n.Log.Level)
+		Conf.Log.Level = n.Log.Level
+	}
+	if Conf.Proto.HandshakeTimeout != n.Proto.HandshakeTimeout {
+		server.DefaultServer.SetHandshakeTimeout(time.Duration(n.Proto.HandshakeTimeout) * time.Second)
+		log.Info("reload proto.handshake_timeout %d -> %d", Conf.Proto.HandshakeTimeout, n.Proto.HandshakeTimeout)
+		Conf.Proto.HandshakeTimeout = n.Proto.HandshakeTimeout
+	}
+	if Conf.Proto.WriteTimeout != n.Proto.WriteTimeout {
+		server.DefaultServer.SetWriteTimeout(time.Duration(n.Proto.WriteTimeout) * time.Second)
+		log.Info("reload proto.write_timeout %d -> %d", Conf.Proto.WriteTimeout, n.Proto.WriteTimeout)
+		Conf.Proto.WriteTimeout = n.Proto.WriteTimeout
+	}
+	if Conf.Proto.Overflow != n.Proto.Overflow {
+		overflow, _ := zone.ParseOverflow(n.Proto.Overflow)
+		server.DefaultServer.SetOverflow(overflow)
+		log.Info("reload proto.overflow %s -> %s", Conf.Proto.Overflow, n.Proto.Overflow)
+		Conf.Proto.Overflow = n.Proto.Overflow
+	}
+	if Conf.Auth.Heartbeat != n.Auth.Heartbeat {
+		Auth.SetHeartbeat(time.Duration(n.Auth.Heartbeat) * time.Second)
+		log.Info("reload auth.heartbeat %d -> %d", Conf.Auth.Heartbeat, n.Auth.Heartbeat)
+		Conf.Auth.Heartbeat = n.Auth.Heartbeat
+	}
+	if Conf.MaxConn != n.MaxConn {
+		server.DefaultServer.SetMaxConn(n.MaxConn)
+		log.Info("reload max_conn %d -> %d", Conf.MaxConn, n.MaxConn)
+		Conf.MaxConn = n.MaxConn
+	}
+	if Conf.DupLogin != n.DupLogin {
+		dupLogin, _ := zone.ParseDupLogin(n.DupLogin)
+		server.DefaultServer.SetDupLogin(dupLogin)
+		log.Info("reload dup_login %s -> %s", Conf.DupLogin, n.DupLogin)
+		Conf.DupLogin = n.DupLogin
+	}
+	if server.DefaultWhitelist != nil && !reflect.DeepEqual(Conf.Whitelist, n.Whitelist) {
+		// keys edited by the admin endpoint are replaced
+		server.DefaultWhitelist.Set(n.Whitelist)
+		log.Info("reload white_list %v -> %v", Conf.Whitelist, n.Whitelist)
+		Conf.Whitelist = n.Whitelist
+	}
+	if !reflect.DeepEqual(Conf.Access, n.Access) {
+		allow, _ := inet.ParseCIDRs(n.Access.Allow)
+		deny, _ := inet.ParseCIDRs(n.Access.Deny)
+		if e := server.DefaultServer.Options.Access.Set(allow, deny, n.Access.File); e != nil {
+			log.Error("reload access error(%v), rules kept", e)
+		} else {
+			log.Info("reload access %v -> %v", Conf.Access, n.Access)
+			Conf.Access = n.Access
+		}
+	} else {
+		// same file, it may be edited
+		server.DefaultServer.Options.Access.Reload()
+	}
+	// same cert files, they may be renewed
+	server.DefaultServer.ReloadCerts()
+	Conf.DrainTimeout = n.DrainTimeout
+	Conf.StatBind = n.StatBind
+	stat.ReloadStats(Conf.StatBind.StringSlice())
+	Conf.PprofBind = n.PprofBind
+	pprof.Reload(Conf.PprofBind.StringSlice())
+	log.Info("reload config %s done", confPath)
+}
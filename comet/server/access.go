@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"im/comet/stat"
+	"im/pkg/log"
+	inet "im/pkg/net"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	accessWatchInterval = 10 * time.Second
+)
+
+var (
+	ErrAccessDenied = errors.New("access denied")
+)
+
+// AccessControl allow or deny client ips by cidr, checked at accept before
+// any buffer is taken. A denied ip is rejected, if any allow cidr is set an
+// ip not allowed is rejected too, the others are accepted.
+//
+// The rules are the config lists plus a file, one rule a line:
+//
+//	allow 10.0.0.0/8
+//	deny  192.168.1.1
+//
+// the file is reloaded when it changes or Reload is called.
+type AccessControl struct {
+	lock      sync.RWMutex
+	allow     inet.CIDRs // config and file
+	deny      inet.CIDRs
+	cfgAllow  inet.CIDRs
+	cfgDeny   inet.CIDRs
+	file      string
+	modTime   time.Time
+	watchOnce sync.Once
+}
+
+// NewAccessControl load the rules and watch the file if not empty.
+func NewAccessControl(allow, deny inet.CIDRs, file string) (a *AccessControl, err error) {
+	a = new(AccessControl)
+	if err = a.Set(allow, deny, file); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Set replace the config rules and the file, the old rules are kept if the
+// file failed.
+func (a *AccessControl) Set(allow, deny inet.CIDRs, file string) (err error) {
+	var (
+		fAllow, fDeny inet.CIDRs
+		modTime       time.Time
+	)
+	if file != "" {
+		if fAllow, fDeny, modTime, err = loadAccessFile(file); err != nil {
+			return
+		}
+		a.watchOnce.Do(func() { go a.watch() })
+	}
+	a.lock.Lock()
+	a.cfgAllow, a.cfgDeny, a.file, a.modTime = allow, deny, file, modTime
+	a.allow = append(append(inet.CIDRs{}, allow...), fAllow...)
+	a.deny = append(append(inet.CIDRs{}, deny...), fDeny...)
+	a.lock.Unlock()
+	return
+}
+
+// Reload reload the file, the old rules are kept if failed.
+func (a *AccessControl) Reload() (err error) {
+	a.lock.RLock()
+	allow, deny, file := a.cfgAllow, a.cfgDeny, a.file
+	a.lock.RUnlock()
+	if file == "" {
+		return
+	}
+	if err = a.Set(allow, deny, file); err != nil {
+		log.Error("access file \"%s\" reload error(%v)", file, err)
+		return
+	}
+	log.Info("load access file \"%s\"", file)
+	return
+}
+
+// Allowed check the ip, nil (unix socket) is always allowed. The rejection
+// is counted in stat.AccessStat.
+func (a *AccessControl) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return true
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if a.deny.Contains(ip) {
+		stat.AccessStat.IncrDenied()
+		return false
+	}
+	if len(a.allow) > 0 && !a.allow.Contains(ip) {
+		stat.AccessStat.IncrNotAllowed()
+		return false
+	}
+	return true
+}
+
+// loadAccessFile parse the allow and deny rules of the file.
+func loadAccessFile(file string) (allow, deny inet.CIDRs, modTime time.Time, err error) {
+	var (
+		f     *os.File
+		fi    os.FileInfo
+		cidrs inet.CIDRs
+		line  int
+	)
+	if f, err = os.Open(file); err != nil {
+		return
+	}
+	defer f.Close()
+	if fi, err = f.Stat(); err != nil {
+		return
+	}
+	modTime = fi.ModTime()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line++
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			err = fmt.Errorf("access file \"%s\" line %d: want \"allow|deny cidr\"", file, line)
+			return
+		}
+		if cidrs, err = inet.ParseCIDRs(fields[1:]); err != nil {
+			err = fmt.Errorf("access file \"%s\" line %d: %v", file, line, err)
+			return
+		}
+		switch fields[0] {
+		case "allow":
+			allow = append(allow, cidrs...)
+		case "deny":
+			deny = append(deny, cidrs...)
+		default:
+			err = fmt.Errorf("access file \"%s\" line %d: unknown rule \"%s\"", file, line, fields[0])
+			return
+		}
+	}
+	err = s.Err()
+	return
+}
+
+func (a *AccessControl) watch() {
+	for {
+		time.Sleep(accessWatchInterval)
+		a.lock.RLock()
+		file, modTime := a.file, a.modTime
+		a.lock.RUnlock()
+		if file == "" {
+			continue
+		}
+		if fi, err := os.Stat(file); err == nil && fi.ModTime().After(modTime) {
+			a.Reload()
+		}
+	}
+}
+
+// allowed check the client address by the access control if set.
+func (server *Server) allowed(addr net.Addr) bool {
+	if server.Options.Access == nil {
+		return true
+	}
+	return server.Options.Access.Allowed(inet.AddrIP(addr))
+}
+
+// accessListener close the rejected conns at accept. The client address of
+// a PROXY protocol conn is not known yet, accessHandler checks it.
+func (server *Server) accessListener(l net.Listener) net.Listener {
+	if server.Options.Access == nil || server.Options.ProxyWebsocket {
+		return l
+	}
+	return &accessListener{Listener: l, server: server}
+}
+
+type accessListener struct {
+	net.Listener
+	server *Server
+}
+
+func (l *accessListener) Accept() (c net.Conn, err error) {
+	for {
+		if c, err = l.Listener.Accept(); err != nil {
+			return
+		}
+		if l.server.allowed(c.RemoteAddr()) {
+			return
+		}
+		log.Warn("access rejected %s", c.RemoteAddr())
+		c.Close()
+	}
+}
+
+// accessHandler reject the requests of PROXY protocol conns by the client
+// address in the header.
+func (server *Server) accessHandler(h http.Handler) http.Handler {
+	if server.Options.Access == nil || !server.Options.ProxyWebsocket {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err == nil && !server.Options.Access.Allowed(net.ParseIP(host)) {
+			log.Warn("access rejected %s", r.RemoteAddr)
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
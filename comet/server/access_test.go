@@ -0,0 +1,51 @@
+package server
+
+import (
+	inet "im/pkg/net"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccessControl(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "access.conf")
+	rules := "# office\nallow 10.0.0.0/8\n\ndeny 10.1.0.0/16\n"
+	if err := ioutil.WriteFile(file, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	allow, _ := inet.ParseCIDRs([]string{"::1"})
+	deny, _ := inet.ParseCIDRs([]string{"10.2.3.4"})
+	a, err := NewAccessControl(allow, deny, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		ip string
+		ok bool
+	}{
+		{"10.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", false},
+		{"10.2.3.4", false},
+		{"192.168.0.1", false},
+		{"", true}, // unix socket
+	}
+	for _, c := range cases {
+		if ok := a.Allowed(net.ParseIP(c.ip)); ok != c.ok {
+			t.Errorf("ip \"%s\" got %v", c.ip, ok)
+		}
+	}
+	if err = ioutil.WriteFile(file, []byte("block 1.1.1.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Reload(); err == nil {
+		t.Errorf("bad rule reloaded")
+	}
+	if a.Allowed(net.ParseIP("10.1.2.3")) {
+		t.Errorf("rules not kept after a failed reload")
+	}
+	if err = a.Set(nil, nil, ""); err != nil || !a.Allowed(net.ParseIP("10.1.2.3")) {
+		t.Errorf("empty rules reject, error(%v)", err)
+	}
+}
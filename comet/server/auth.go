@@ -0,0 +1,173 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"im/comet/proto"
+	"im/comet/zone"
+	"im/pkg/log"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrAuthRejected = errors.New("auth rejected")
+)
+
+// Identity is what an Authenticator returns for an accepted handshake.
+type Identity struct {
+	Uid       uint32
+	Device    string // empty if the client has no device id
+	Platform  string
+	ZoneId    int           // -1 the zone of uid, see Server.NewId
+	Heartbeat time.Duration // session expire without a heartbeat
+	Meta      map[string]string
+}
+
+// Authenticator validates the credentials sent in C2S_AUTH, a code other
+// than proto.AUTH_OK rejects the handshake and is sent back in S2C_AUTH.
+type Authenticator interface {
+	Auth(a *proto.Auth) (ident Identity, code int)
+}
+
+// HMACAuth verify tokens signed by Sign with a shared secret.
+// token: |--expire(unix)--|.|--hex(hmac-sha256(uid:expire))--|
+type HMACAuth struct {
+	secret    []byte
+	heartbeat int64 // time.Duration
+}
+
+// NewHMACAuth new a hmac token authenticator.
+func NewHMACAuth(secret string, heartbeat time.Duration) *HMACAuth {
+	return &HMACAuth{secret: []byte(secret), heartbeat: int64(heartbeat)}
+}
+
+// SetHeartbeat change the heartbeat of sessions authed later.
+func (h *HMACAuth) SetHeartbeat(heartbeat time.Duration) {
+	atomic.StoreInt64(&h.heartbeat, int64(heartbeat))
+}
+
+func (h *HMACAuth) mac(uid uint32, expire int64) string {
+	m := hmac.New(sha256.New, h.secret)
+	fmt.Fprintf(m, "%d:%d", uid, expire)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// Sign sign a token for uid valid until expire.
+func (h *HMACAuth) Sign(uid uint32, expire time.Time) string {
+	return fmt.Sprintf("%d.%s", expire.Unix(), h.mac(uid, expire.Unix()))
+}
+
+// Verify check the token of uid, return the auth reply code.
+func (h *HMACAuth) Verify(uid uint32, token string) (code int) {
+	var (
+		expire int64
+		err    error
+		ix     = strings.Index(token, ".")
+	)
+	if ix < 0 {
+		return proto.AUTH_INVALID
+	}
+	if expire, err = strconv.ParseInt(token[:ix], 10, 64); err != nil {
+		return proto.AUTH_INVALID
+	}
+	if !hmac.Equal([]byte(token[ix+1:]), []byte(h.mac(uid, expire))) {
+		return proto.AUTH_INVALID
+	}
+	if time.Now().Unix() > expire {
+		return proto.AUTH_EXPIRED
+	}
+	return proto.AUTH_OK
+}
+
+func (h *HMACAuth) Auth(a *proto.Auth) (ident Identity, code int) {
+	if code = h.Verify(a.Uid, a.Code); code != proto.AUTH_OK {
+		return
+	}
+	ident.Uid = a.Uid
+	ident.Device = a.Device
+	ident.Platform = a.Platform
+	ident.ZoneId = -1
+	ident.Heartbeat = time.Duration(atomic.LoadInt64(&h.heartbeat))
+	return
+}
+
+var authMsg = map[int]string{
+	proto.AUTH_INVALID:   "invalid token",
+	proto.AUTH_EXPIRED:   "token expired",
+	proto.AUTH_DENIED:    "access denied",
+	proto.AUTH_DUPLICATE: "already online",
+}
+
+// authenticate check the C2S_AUTH proto by the server authenticator and turn
+// it into the S2C_AUTH reply, the reply must be sent even if rejected.
+func (server *Server) authenticate(p *proto.Proto) (ident Identity, err error) {
+	var (
+		auth proto.Auth
+		code int
+	)
+	if err = json.Unmarshal(p.Body, &auth); err != nil {
+		log.Warn("auth body %s unmarshal error(%v)", p.Body, err)
+		code = proto.AUTH_INVALID
+	} else if server.Options.Authenticator == nil {
+		code = proto.AUTH_DENIED
+	} else {
+		ident, code = server.Options.Authenticator.Auth(&auth)
+	}
+	log.Debug("uid = %v auth code %d", auth.Uid, code)
+	err = authReply(p, code)
+	return
+}
+
+// authReply turn p into the S2C_AUTH reply of code, ErrAuthRejected is
+// returned if the code is not AUTH_OK.
+func authReply(p *proto.Proto, code int) (err error) {
+	reply := proto.AuthReply{Code: code, Msg: authMsg[code]}
+	p.Type = proto.S2C_AUTH
+	if p.Body, err = json.Marshal(&reply); err != nil {
+		return
+	}
+	if code != proto.AUTH_OK {
+		err = ErrAuthRejected
+	}
+	return
+}
+
+// connect authenticate the C2S_AUTH proto p, bind the session and put it
+// into its zone. meta of the transport is added to the identity meta. p is
+// turned into the S2C_AUTH reply which must be sent even if an error is
+// returned.
+func (server *Server) connect(p *proto.Proto, sion *zone.Session, addr string, conn io.Closer, meta map[string]string) (ident Identity, err error) {
+	if ident, err = server.authenticate(p); err != nil {
+		return
+	}
+	if len(meta) > 0 {
+		// ident meta may be shared by the authenticator
+		m := make(map[string]string, len(ident.Meta)+len(meta))
+		for k, v := range ident.Meta {
+			m[k] = v
+		}
+		for k, v := range meta {
+			m[k] = v
+		}
+		ident.Meta = m
+	}
+	server.bind(sion, server.NewId(ident.Uid, ident.ZoneId), ident, addr, conn)
+	switch err = server.login(sion); err {
+	case zone.ErrSessionDuplicate:
+		log.Warn("uid = %v already online, reject %s", ident.Uid, addr)
+		authReply(p, proto.AUTH_DUPLICATE)
+	case ErrServerClosing:
+		// shared by all sessions, body must not be nil
+		p.Type, p.Body = proto.S2C_RECONNECT, emptyJSONBody
+	}
+	trace(sion, "auth", p)
+	return
+}
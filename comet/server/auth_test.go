@@ -0,0 +1,67 @@
+package server
+
+import (
+	"im/comet/proto"
+	"im/comet/zone"
+	"testing"
+	"time"
+)
+
+func TestHMACAuth(t *testing.T) {
+	h := NewHMACAuth("secret", time.Second)
+	token := h.Sign(10, time.Now().Add(time.Minute))
+	if code := h.Verify(10, token); code != proto.AUTH_OK {
+		t.Fatalf("verify code %d", code)
+	}
+	if code := h.Verify(11, token); code != proto.AUTH_INVALID {
+		t.Fatalf("other uid verify code %d", code)
+	}
+	if code := NewHMACAuth("other", time.Second).Verify(10, token); code != proto.AUTH_INVALID {
+		t.Fatalf("other secret verify code %d", code)
+	}
+	if code := h.Verify(10, "bad"); code != proto.AUTH_INVALID {
+		t.Fatalf("bad token verify code %d", code)
+	}
+	token = h.Sign(10, time.Now().Add(-time.Minute))
+	if code := h.Verify(10, token); code != proto.AUTH_EXPIRED {
+		t.Fatalf("expired verify code %d", code)
+	}
+	ident, code := h.Auth(&proto.Auth{Uid: 10, Code: h.Sign(10, time.Now().Add(time.Minute))})
+	if code != proto.AUTH_OK || ident.Uid != 10 || ident.ZoneId != -1 || ident.Heartbeat != time.Second {
+		t.Fatalf("auth ident %v code %d", ident, code)
+	}
+}
+
+func TestConnectKick(t *testing.T) {
+	var (
+		server = newTestServer(ServerOptions{SvrProto: 2})
+		p      = &proto.Proto{Type: proto.C2S_AUTH, Body: testAuthBody(6, "d1")}
+		old    = zone.NewSession(0, -1, 4, 2)
+	)
+	if _, err := server.connect(p, old, "old", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	// nobody reads the old session, its cache is full
+	server.PushUser(6, "", &proto.Proto{Type: proto.S2C_CALCULATE})
+	server.PushUser(6, "", &proto.Proto{Type: proto.S2C_CALCULATE})
+	done := make(chan error)
+	go func() {
+		p := &proto.Proto{Type: proto.C2S_AUTH, Body: testAuthBody(6, "d1")}
+		_, err := server.connect(p, zone.NewSession(0, -1, 4, 2), "new", nil, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("login blocked by kicking a full session")
+	}
+	if p = old.Ready(); p.Type != proto.S2C_KICKED {
+		t.Fatalf("kicked notice %v", p)
+	}
+	if old.Ready() != proto.ProtoFinish {
+		t.Fatal("kicked session not finished")
+	}
+}
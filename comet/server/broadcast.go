@@ -0,0 +1,111 @@
+package server
+
+import (
+	"im/comet/proto"
+	"im/comet/zone"
+	"sync"
+	"time"
+)
+
+const (
+	// a rate limited zone takes the tokens of about one interval at once
+	broadcastInterval = 10 * time.Millisecond
+)
+
+type BroadcastOptions struct {
+	Rate     int    // deliveries per second over all zones, 0 unlimited
+	Platform string // only sessions on platform if not empty
+}
+
+// Broadcast push p to every session, p is encoded once as a raw proto and
+// the zones are walked in parallel. With a rate the zones share one limiter
+// and Broadcast returns once all are pushed, callers should run it in a
+// goroutine. Returns the number of sessions queued it.
+func (server *Server) Broadcast(p *proto.Proto, options BroadcastOptions) (n int) {
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		limiter *broadcastLimiter
+	)
+	if p.Type != proto.PROTO_RAW {
+		p = proto.NewRaw(p)
+	}
+	if options.Rate > 0 {
+		limiter = newBroadcastLimiter(options.Rate)
+	}
+	for _, z := range server.Zones {
+		wg.Add(1)
+		go func(z *zone.Zone) {
+			zn := broadcastZone(z, p, options.Platform, limiter)
+			lock.Lock()
+			n += zn
+			lock.Unlock()
+			wg.Done()
+		}(z)
+	}
+	wg.Wait()
+	return
+}
+
+// broadcastLimiter pace the deliveries of all zones to rate a second. The
+// i-th token is due at start + i/rate, so at any time at most rate*elapsed+1
+// deliveries are done however many zones take tokens.
+type broadcastLimiter struct {
+	lock  sync.Mutex
+	rate  int64
+	batch int // tokens of one interval
+	start time.Time
+	taken int64
+}
+
+func newBroadcastLimiter(rate int) *broadcastLimiter {
+	batch := rate * int(broadcastInterval) / int(time.Second)
+	if batch == 0 {
+		batch = 1
+	}
+	return &broadcastLimiter{rate: int64(rate), batch: batch, start: time.Now()}
+}
+
+// take take at most want tokens, waiting until the last of them is due.
+func (l *broadcastLimiter) take(want int) int {
+	if want > l.batch {
+		want = l.batch
+	}
+	l.lock.Lock()
+	last := l.taken + int64(want) - 1
+	l.taken += int64(want)
+	l.lock.Unlock()
+	if d := time.Until(l.start.Add(time.Duration(last * int64(time.Second) / l.rate))); d > 0 {
+		time.Sleep(d)
+	}
+	return want
+}
+
+// broadcastZone push p to the sessions of z, paced by limiter if not nil.
+// The sessions are taken once, the ones put later miss it.
+func broadcastZone(z *zone.Zone, p *proto.Proto, platform string, limiter *broadcastLimiter) (n int) {
+	var (
+		tokens   int
+		sessions = z.Sessions()
+	)
+	if platform != "" {
+		// only the matched ones take tokens
+		matched := sessions[:0]
+		for _, session := range sessions {
+			if session.Platform == platform {
+				matched = append(matched, session)
+			}
+		}
+		sessions = matched
+	}
+	for i, session := range sessions {
+		if limiter != nil && tokens == 0 {
+			tokens = limiter.take(len(sessions) - i)
+		}
+		tokens--
+		if session.Push(p) == nil {
+			n++
+		}
+	}
+	return
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"im/comet/proto"
+	"im/comet/stat"
+	"im/comet/zone"
+	"testing"
+	"time"
+)
+
+func testBroadcastServer(zoneNum, sessionNum int) (*Server, []*zone.Session) {
+	stat.SvrZones = stat.NewZonesStat(zoneNum)
+	zones := make([]*zone.Zone, zoneNum)
+	for i := range zones {
+		zones[i] = zone.NewZone(i, zone.ZoneOptions{})
+	}
+	server := NewServer(zones, nil, nil, ServerOptions{})
+	sessions := make([]*zone.Session, sessionNum)
+	for i := range sessions {
+		s := zone.NewSession(server.NewId(uint32(i), -1), -1, 1, 2)
+		s.Uid = uint32(i)
+		if i < 4 {
+			s.Platform = "web"
+		}
+		server.Zone(s.Id).Put(s, zone.DupLoginAllow)
+		sessions[i] = s
+	}
+	return server, sessions
+}
+
+func TestBroadcast(t *testing.T) {
+	server, sessions := testBroadcastServer(2, 20)
+	p := &proto.Proto{Type: proto.S2C_CALCULATE, Body: []byte("{}")}
+	if n := server.Broadcast(p, BroadcastOptions{Platform: "web"}); n != 4 {
+		t.Fatalf("platform broadcast %d", n)
+	}
+	if n := server.Broadcast(p, BroadcastOptions{}); n != 20 {
+		t.Fatalf("broadcast %d", n)
+	}
+	if p := sessions[19].Ready(); p.Type != proto.PROTO_RAW {
+		t.Fatalf("pushed %v", p)
+	}
+}
+
+func TestBroadcastRate(t *testing.T) {
+	const rate = 100
+	// far more zones than the rate a tick, and most zones nearly empty
+	server, _ := testBroadcastServer(256, 60)
+	p := &proto.Proto{Type: proto.S2C_CALCULATE, Body: []byte("{}")}
+	start := time.Now()
+	n := server.Broadcast(p, BroadcastOptions{Rate: rate})
+	elapsed := time.Since(start)
+	if n != 60 {
+		t.Fatalf("broadcast %d", n)
+	}
+	// the first delivery is at once, the others paced
+	if got := float64(n-1) / elapsed.Seconds(); got > rate*1.05 {
+		t.Errorf("%d deliveries in %v, %.0f/s over rate %d/s", n, elapsed, got, rate)
+	}
+	if elapsed > 2*time.Second {
+		t.Errorf("broadcast too slow %v", elapsed)
+	}
+
+	l := newBroadcastLimiter(1000)
+	start = time.Now()
+	for taken := 0; taken < 101; {
+		taken += l.take(101 - taken)
+	}
+	if elapsed = time.Since(start); elapsed < 95*time.Millisecond {
+		t.Errorf("101 tokens at 1000/s in %v", elapsed)
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/tls"
+	"im/pkg/log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	certWatchInterval = 10 * time.Second
+)
+
+// CertReloader serve a key pair to tls handshakes, reloaded when the files
+// change or Reload is called, without closing the listeners.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time // latest mod time of the two files
+}
+
+// NewCertReloader load the key pair and watch the files.
+func NewCertReloader(certFile, keyFile string) (r *CertReloader, err error) {
+	r = &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err = r.Reload(); err != nil {
+		return nil, err
+	}
+	go r.watch()
+	return
+}
+
+// Reload load the key pair, the old one is kept if failed.
+func (r *CertReloader) Reload() (err error) {
+	var (
+		cert    tls.Certificate
+		modTime = r.filesModTime()
+	)
+	if cert, err = tls.LoadX509KeyPair(r.certFile, r.keyFile); err != nil {
+		log.Error("tls.LoadX509KeyPair(\"%s\", \"%s\") error(%v)", r.certFile, r.keyFile, err)
+		return
+	}
+	r.lock.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.lock.Unlock()
+	log.Info("load certificate \"%s\"", r.certFile)
+	return
+}
+
+// GetCertificate is used as tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (cert *tls.Certificate, err error) {
+	r.lock.RLock()
+	cert = r.cert
+	r.lock.RUnlock()
+	return
+}
+
+// TLSConfig new a tls config serving the reloaded key pair.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: r.GetCertificate}
+}
+
+func (r *CertReloader) filesModTime() (t time.Time) {
+	for _, file := range []string{r.certFile, r.keyFile} {
+		if fi, err := os.Stat(file); err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return
+}
+
+func (r *CertReloader) watch() {
+	for {
+		time.Sleep(certWatchInterval)
+		r.lock.RLock()
+		modTime := r.modTime
+		r.lock.RUnlock()
+		if r.filesModTime().After(modTime) {
+			r.Reload()
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"im/comet/handle"
+	"im/comet/proto"
+	"im/comet/zone"
+	"im/pkg/bytes"
+	"im/pkg/log"
+	itime "im/pkg/time"
+	mrand "math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// pollSession is a long polling session, the client authenticates once and
+// then polls the queued protos and sends requests with the token, each by a
+// separate http request.
+type pollSession struct {
+	token   string
+	server  *Server
+	sion    *zone.Session
+	ctx     *handle.Context
+	tr      *itime.Timer
+	trd     *itime.TimerData
+	ident   Identity
+	polling int32      // one poll at a time
+	send    sync.Mutex // one send at a time, the ring has one writer
+	closed  sync.Once
+}
+
+// pollConn is the transport closed by Kick, which may be called under a zone
+// or room lock, so it only finishes the session. The next poll reading the
+// finish or the heartbeat timer removes it.
+type pollConn struct {
+	sion *zone.Session
+}
+
+func (c *pollConn) Close() error {
+	c.sion.Close()
+	return nil
+}
+
+// Close remove the session, called on heartbeat expire, handle error or a
+// poll reading the session finished.
+func (ps *pollSession) Close() error {
+	ps.closed.Do(func() {
+		ps.server.delPoll(ps.token)
+		if err := ps.server.Disconect(ps.sion.Id); err != nil {
+			log.Error("id: %v do disconnect error(%v)", ps.sion.Id, err)
+		}
+		ps.tr.Del(ps.trd)
+		// no dispatch goroutine drains the cache
+		ps.sion.Discard()
+		ps.server.release()
+	})
+	return nil
+}
+
+// handlePoll register the long polling endpoints next to /sub:
+//
+//	POST /poll/auth               C2S_AUTH proto, replied with the token
+//	GET  /poll?token=             hold until protos queued or poll timeout
+//	POST /poll/send?token=        a proto fed to the handlers, the reply is polled
+func (server *Server) handlePoll(mux *http.ServeMux) {
+	mux.HandleFunc("/poll/auth", server.servePollAuth)
+	mux.HandleFunc("/poll", server.servePoll)
+	mux.HandleFunc("/poll/send", server.servePollSend)
+}
+
+func newPollToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (server *Server) addPoll(ps *pollSession) {
+	server.pollLock.Lock()
+	server.polls[ps.token] = ps
+	server.pollLock.Unlock()
+}
+
+func (server *Server) delPoll(token string) {
+	server.pollLock.Lock()
+	delete(server.polls, token)
+	server.pollLock.Unlock()
+}
+
+// pollSession get the session of the request token, the error is replied.
+func (server *Server) pollSession(w http.ResponseWriter, r *http.Request, method string) (ps *pollSession) {
+	if r.Method != method {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	if !checkOrigin(r, server.origins) {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	server.pollLock.Lock()
+	ps = server.polls[r.URL.Query().Get("token")]
+	server.pollLock.Unlock()
+	if ps == nil {
+		// expired or kicked, auth again
+		http.Error(w, "Gone", 410)
+	}
+	return
+}
+
+func (server *Server) servePollAuth(w http.ResponseWriter, r *http.Request) {
+	var (
+		err  error
+		p    *proto.Proto
+		sion = zone.NewSession(0, -1, server.Options.CliProto, server.Options.SvrProto)
+		ps   = &pollSession{token: newPollToken(), server: server, sion: sion}
+	)
+	// closed by kick or shutdown without blocking, read by the next poll
+	sion.Detached = true
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	if !checkOrigin(r, server.origins) {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	if !server.acquire() {
+		log.Warn("max conn reached, reject %s", r.RemoteAddr)
+		http.Error(w, "Service Unavailable", 503)
+		return
+	}
+	// must not setadv, only used in auth
+	p, _ = sion.CliProto.Set()
+	if err = json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(proto.MaxPackSize))).Decode(p); err != nil || p.Type != proto.C2S_AUTH {
+		log.Warn("poll auth proto %v not valid error(%v)", p, err)
+		http.Error(w, "Bad Request", 400)
+		server.release()
+		return
+	}
+	ps.tr = server.round.Timer(mrand.Int())
+	ps.trd = ps.tr.Add(server.HandshakeTimeout(), func() {
+		ps.Close()
+	})
+	if ps.ident, err = server.connect(p, sion, r.RemoteAddr, &pollConn{sion: sion}, nil); err == nil {
+		ps.trd.Key = sion.Id
+		ps.tr.Set(ps.trd, ps.ident.Heartbeat)
+		ps.ctx = handle.NewContext(server, sion)
+		server.addPoll(ps)
+		p.Body, _ = json.Marshal(&proto.AuthReply{Code: proto.AUTH_OK, Token: ps.token})
+	} else {
+		log.Error("poll handshake failed error(%v)", err)
+		ps.tr.Del(ps.trd)
+		server.release()
+	}
+	// reply before reject, client must know the reason code
+	writePoll(w, []*proto.Proto{p})
+}
+
+func (server *Server) servePoll(w http.ResponseWriter, r *http.Request) {
+	var (
+		p       *proto.Proto
+		ps      *pollSession
+		ps2     []*proto.Proto
+		finish  bool
+		timeout = server.Options.Websocket.PollTimeout
+	)
+	if ps = server.pollSession(w, r, "GET"); ps == nil {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&ps.polling, 0, 1) {
+		http.Error(w, "Conflict", 409)
+		return
+	}
+	defer atomic.StoreInt32(&ps.polling, 0)
+	// a polling client is alive
+	ps.tr.Set(ps.trd, ps.ident.Heartbeat)
+	for !finish {
+		if p = ps.sion.ReadyTimeout(timeout); p == nil {
+			break
+		}
+		// return what is queued once anything comes
+		timeout = 0
+		switch p {
+		case proto.ProtoFinish:
+			finish = true
+		case proto.ProtoReady:
+			// fetch message from svrbox(client send)
+			for {
+				if p, _ = ps.sion.CliProto.Get(); p == nil {
+					break
+				}
+				// copy, the ring slot is reused by the next send
+				cp := *p
+				ps2 = append(ps2, &cp)
+				p.Body = nil // avoid memory leak
+				ps.sion.CliProto.GetAdv()
+			}
+		default:
+			ps2 = append(ps2, p)
+		}
+	}
+	if finish {
+		ps.Close()
+	}
+	for _, p = range ps2 {
+		trace(ps.sion, "write", p)
+	}
+	writePoll(w, ps2)
+}
+
+func (server *Server) servePollSend(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+		p   *proto.Proto
+		ps  *pollSession
+	)
+	if ps = server.pollSession(w, r, "POST"); ps == nil {
+		return
+	}
+	ps.send.Lock()
+	defer ps.send.Unlock()
+	if p, err = ps.sion.CliProto.Set(); err != nil {
+		// the client sends faster than it polls
+		http.Error(w, "Too Many Requests", 429)
+		return
+	}
+	p.Reset()
+	if err = json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(proto.MaxPackSize))).Decode(p); err != nil {
+		http.Error(w, "Bad Request", 400)
+		return
+	}
+	if err = server.handleProto(ps.ctx, p, ps.tr, ps.trd, ps.ident.Heartbeat); err != nil {
+		log.Error("id: %v, server handle proto %v error(%v)", ps.sion.Id, p, err)
+		http.Error(w, "Internal Server Error", 500)
+		ps.Close()
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writePoll reply the protos as one json array like the websocket frames, a
+// raw proto is expanded.
+func writePoll(w http.ResponseWriter, ps []*proto.Proto) {
+	var (
+		err error
+		b   []byte
+		raw []json.RawMessage
+		js  = []json.RawMessage{}
+	)
+	for _, p := range ps {
+		if p.Type == proto.PROTO_RAW {
+			bw := bytes.NewWriterSize(len(p.Body) + 40*proto.RawHeaderSize)
+			if err = p.WriteBodyTo(bw); err == nil {
+				if err = json.Unmarshal(bw.Buffer(), &raw); err == nil {
+					js = append(js, raw...)
+				}
+			}
+		} else {
+			// shared by sessions, must not set the body
+			cp := *p
+			if cp.Body == nil {
+				cp.Body = emptyJSONBody
+			}
+			if b, err = json.Marshal(&cp); err == nil {
+				js = append(js, b)
+			}
+		}
+		if err != nil {
+			log.Error("poll proto %v marshal error(%v)", p, err)
+		}
+	}
+	if b, err = json.Marshal(js); err != nil {
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(b)
+}
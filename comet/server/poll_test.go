@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"im/comet/handle"
+	"im/comet/proto"
+	"im/comet/stat"
+	"im/comet/utils"
+	"im/comet/zone"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestServer new a server of 2 zones authenticating by testAuth.
+func newTestServer(options ServerOptions) *Server {
+	stat.SvrZones = stat.NewZonesStat(2)
+	zones := []*zone.Zone{zone.NewZone(0, zone.ZoneOptions{}), zone.NewZone(1, zone.ZoneOptions{})}
+	round := utils.NewRound(utils.RoundOptions{TimerNum: 1, TimerSize: 16})
+	if options.CliProto == 0 {
+		options.CliProto = 4
+	}
+	if options.SvrProto == 0 {
+		options.SvrProto = 4
+	}
+	if options.HandshakeTimeout == 0 {
+		options.HandshakeTimeout = time.Second
+	}
+	options.Authenticator = testAuth
+	return NewServer(zones, round, handle.NewDefaultRouter(), options)
+}
+
+var testAuth = NewHMACAuth("secret", time.Second)
+
+func testAuthBody(uid uint32, device string) []byte {
+	b, _ := json.Marshal(&proto.Auth{Uid: uid, Code: testAuth.Sign(uid, time.Now().Add(time.Minute)), Device: device})
+	return b
+}
+
+func testPollAuth(t *testing.T, url string, uid uint32, device string) string {
+	b, _ := json.Marshal(&proto.Proto{Type: proto.C2S_AUTH, Body: testAuthBody(uid, device)})
+	ps := testPollDo(t, "POST", url+"/poll/auth", b, 200)
+	var reply proto.AuthReply
+	if len(ps) != 1 || json.Unmarshal(ps[0].Body, &reply) != nil || reply.Code != proto.AUTH_OK || reply.Token == "" {
+		t.Fatalf("poll auth reply %v", ps)
+	}
+	return reply.Token
+}
+
+func testPollDo(t *testing.T, method, url string, body []byte, code int) (ps []proto.Proto) {
+	req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != code {
+		t.Fatalf("%s %s code %d, want %d", method, url, resp.StatusCode, code)
+	}
+	if code == 200 {
+		json.NewDecoder(resp.Body).Decode(&ps)
+	}
+	return
+}
+
+func TestPoll(t *testing.T) {
+	server := newTestServer(ServerOptions{Websocket: WebsocketOptions{PollTimeout: 100 * time.Millisecond}})
+	mux := http.NewServeMux()
+	server.handlePoll(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// rejected auth gets the reply
+	b, _ := json.Marshal(&proto.Proto{Type: proto.C2S_AUTH, Body: []byte(`{"uid":1,"code":"bad"}`)})
+	if ps := testPollDo(t, "POST", ts.URL+"/poll/auth", b, 200); len(ps) != 1 || ps[0].Type != proto.S2C_AUTH {
+		t.Fatalf("rejected auth reply %v", ps)
+	}
+	token := testPollAuth(t, ts.URL, 1, "d1")
+
+	// nothing queued, the poll times out empty
+	start := time.Now()
+	if ps := testPollDo(t, "GET", ts.URL+"/poll?token="+token, nil, 200); len(ps) != 0 {
+		t.Fatalf("empty poll %v", ps)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("poll returned in %v", d)
+	}
+
+	// a push wakes the held poll up
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		server.PushUser(1, "", &proto.Proto{Type: proto.S2C_CALCULATE, Body: []byte(`{"a":1}`)})
+	}()
+	if ps := testPollDo(t, "GET", ts.URL+"/poll?token="+token, nil, 200); len(ps) != 1 || ps[0].Type != proto.S2C_CALCULATE {
+		t.Fatalf("pushed poll %v", ps)
+	}
+
+	// a request is replied by the next poll
+	b, _ = json.Marshal(&proto.Proto{Type: proto.C2S_HEART_BEAT, SeqId: 9, Body: []byte(`{}`)})
+	testPollDo(t, "POST", ts.URL+"/poll/send?token="+token, b, 204)
+	if ps := testPollDo(t, "GET", ts.URL+"/poll?token="+token, nil, 200); len(ps) != 1 || ps[0].Type != proto.S2C_HEART_BEAT || ps[0].SeqId != 9 {
+		t.Fatalf("reply poll %v", ps)
+	}
+	testPollDo(t, "GET", ts.URL+"/poll?token=bad", nil, 410)
+}
+
+func TestPollKickAndExpire(t *testing.T) {
+	server := newTestServer(ServerOptions{SvrProto: 1, Websocket: WebsocketOptions{PollTimeout: 50 * time.Millisecond}})
+	mux := http.NewServeMux()
+	server.handlePoll(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// a full poll session is kicked by a login of the same device at once
+	token := testPollAuth(t, ts.URL, 2, "d1")
+	server.PushUser(2, "", &proto.Proto{Type: proto.S2C_CALCULATE, Body: []byte(`{}`)})
+	done := make(chan string)
+	go func() { done <- testPollAuth(t, ts.URL, 2, "d1") }()
+	var token2 string
+	select {
+	case token2 = <-done:
+	case <-time.After(time.Second):
+		t.Fatal("login blocked by kicking a poll session")
+	}
+	testPollDo(t, "GET", ts.URL+"/poll?token="+token, nil, 200)
+	testPollDo(t, "GET", ts.URL+"/poll?token="+token, nil, 410)
+
+	// a full session kicked by the overflow policy never blocks the pushes
+	server.SetOverflow(zone.OverflowDisconnect)
+	token = testPollAuth(t, ts.URL, 4, "d1")
+	pushed := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			server.PushUser(4, "", &proto.Proto{Type: proto.S2C_CALCULATE, Body: []byte(`{}`)})
+		}
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("push blocked by kicking a poll session")
+	}
+	testPollDo(t, "GET", ts.URL+"/poll?token="+token, nil, 200)
+	testPollDo(t, "GET", ts.URL+"/poll?token="+token, nil, 410)
+	if _, err := server.PushUser(4, "", &proto.Proto{Type: proto.S2C_CALCULATE}); err != zone.ErrSessionNotFound {
+		t.Fatalf("kicked session push error(%v)", err)
+	}
+	server.SetOverflow(zone.OverflowDropNewest)
+
+	// shutdown never blocks on poll sessions
+	closed := make(chan struct{})
+	go func() {
+		for _, z := range server.Zones {
+			z.Close()
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("zone close blocked by a poll session")
+	}
+	testPollDo(t, "GET", ts.URL+"/poll?token="+token2, nil, 200)
+	testPollDo(t, "GET", ts.URL+"/poll?token="+token2, nil, 410)
+
+	// no poll for a heartbeat, the session expires
+	token = testPollAuth(t, ts.URL, 3, "d1")
+	time.Sleep(testAuthHeartbeat + 500*time.Millisecond)
+	testPollDo(t, "GET", ts.URL+"/poll?token="+token, nil, 410)
+	if _, err := server.PushUser(3, "", &proto.Proto{Type: proto.S2C_CALCULATE}); err != zone.ErrSessionNotFound {
+		t.Fatalf("expired session push error(%v)", err)
+	}
+}
+
+const testAuthHeartbeat = time.Second
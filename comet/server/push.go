@@ -0,0 +1,212 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"im/comet/proto"
+	"im/comet/stat"
+	"im/pkg/log"
+	inet "im/pkg/net"
+	"net"
+	"net/http"
+)
+
+const (
+	maxPushRequest = 1 << 20 // bytes of a push request
+	maxPushIds     = 1000    // ids of a /push/ids request
+)
+
+// PushRequest is the json body of the push api, the target fields used
+// depend on the endpoint. Body is the json body of the proto pushed, it must
+// fit proto.MaxBodySize.
+type PushRequest struct {
+	Id       uint64          `json:"id"`
+	Ids      []uint64        `json:"ids"`
+	Uid      uint32          `json:"uid"`
+	Device   string          `json:"device"`
+	Platform string          `json:"platform"`
+	Room     string          `json:"room"`
+	Rate     int             `json:"rate"` // broadcast rate, at most the config one
+	Type     int16           `json:"type"` // a S2C or notice type
+	Body     json.RawMessage `json:"body"`
+}
+
+// PushResult is the delivery result of one target.
+type PushResult struct {
+	Id        uint64 `json:"id,omitempty"`
+	Uid       uint32 `json:"uid,omitempty"`
+	Room      string `json:"room,omitempty"`
+	Delivered int    `json:"delivered"` // sessions queued the proto
+	Error     string `json:"error,omitempty"`
+}
+
+type pushAPI struct {
+	server *Server
+	secret []byte
+	rate   int // default broadcast rate
+}
+
+// InitPush listen the push api on addrs, requests must carry the secret as
+// "Authorization: Bearer <secret>":
+//
+//	POST /push/id      {"id", "type", "body"}
+//	POST /push/ids     {"ids", "type", "body"}
+//	POST /push/uid     {"uid", "device" or "platform", "type", "body"}
+//	POST /push/room    {"room", "type", "body"}
+//	POST /push/all     {"platform", "rate", "type", "body"}
+//
+// every call replies {"results": [PushResult]}. A rate limited /push/all
+// replies when the broadcast is done.
+func InitPush(addrs []string, secret string, rate int) (err error) {
+	var (
+		bind     string
+		listener net.Listener
+		mux      = newPushMux(DefaultServer, secret, rate)
+	)
+	for _, bind = range addrs {
+		if listener, err = inet.Listen(bind); err != nil {
+			log.Error("inet.Listen(\"%s\") error(%v)", bind, err)
+			return
+		}
+		server := &http.Server{Handler: mux}
+		DefaultServer.addHTTPServer(server)
+		log.Info("start push listen addr:\"%s\"", bind)
+		go func(host string, server *http.Server, listener net.Listener) {
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.Error("push server.Serve(\"%s\") error(%v)", host, err)
+			}
+		}(bind, server, listener)
+	}
+	return
+}
+
+// newPushMux new the push api handlers of server.
+func newPushMux(server *Server, secret string, rate int) *http.ServeMux {
+	var (
+		api = &pushAPI{server: server, secret: []byte(secret), rate: rate}
+		mux = http.NewServeMux()
+	)
+	mux.HandleFunc("/push/id", api.handle(api.pushId))
+	mux.HandleFunc("/push/ids", api.handle(api.pushIds))
+	mux.HandleFunc("/push/uid", api.handle(api.pushUid))
+	mux.HandleFunc("/push/room", api.handle(api.pushRoom))
+	mux.HandleFunc("/push/all", api.handle(api.pushAll))
+	return mux
+}
+
+// handle check the request and reply the results of fn, which are recorded
+// in stat.MsgStat.
+func (api *pushAPI) handle(fn func(req *PushRequest, p *proto.Proto) []PushResult) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			req     PushRequest
+			results []PushResult
+		)
+		if r.Method != "POST" {
+			http.Error(w, "Method Not Allowed", 405)
+			return
+		}
+		if !bearerAuth(r, api.secret) {
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPushRequest)).Decode(&req); err != nil {
+			log.Warn("push request from %s decode error(%v)", r.RemoteAddr, err)
+			http.Error(w, "Bad Request", 400)
+			return
+		}
+		if len(req.Body) > int(proto.MaxBodySize) || len(req.Ids) > maxPushIds {
+			http.Error(w, "Request Entity Too Large", 413)
+			return
+		}
+		// a raw or signal type would break the transports
+		if req.Type < proto.S2C_BASE || req.Type >= proto.PROTO_READY {
+			http.Error(w, "Bad Request", 400)
+			return
+		}
+		// shared by sessions, body must not be nil
+		p := &proto.Proto{Type: req.Type, Body: []byte(req.Body)}
+		if len(p.Body) == 0 {
+			p.Body = emptyJSONBody
+		}
+		results = fn(&req, p)
+		for _, res := range results {
+			if res.Delivered > 0 {
+				stat.MsgStat.IncrSucceed(uint64(res.Delivered))
+			} else {
+				stat.MsgStat.IncrFailed(1)
+			}
+		}
+		b, _ := json.Marshal(map[string][]PushResult{"results": results})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// bearerAuth check the "Authorization: Bearer <secret>" header, an empty
+// secret accepts nothing.
+func bearerAuth(r *http.Request, secret []byte) bool {
+	if len(secret) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), append([]byte("Bearer "), secret...)) == 1
+}
+
+func pushResult(res PushResult, n int, err error) []PushResult {
+	res.Delivered = n
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return []PushResult{res}
+}
+
+func (api *pushAPI) pushId(req *PushRequest, p *proto.Proto) []PushResult {
+	var n int
+	err := api.server.Push(req.Id, p)
+	if err == nil {
+		n = 1
+	}
+	return pushResult(PushResult{Id: req.Id}, n, err)
+}
+
+func (api *pushAPI) pushIds(req *PushRequest, p *proto.Proto) (results []PushResult) {
+	p = proto.NewRaw(p)
+	results = make([]PushResult, 0, len(req.Ids))
+	for _, id := range req.Ids {
+		results = append(results, api.pushId(&PushRequest{Id: id}, p)...)
+	}
+	return
+}
+
+func (api *pushAPI) pushUid(req *PushRequest, p *proto.Proto) []PushResult {
+	var (
+		n   int
+		err error
+	)
+	p = proto.NewRaw(p)
+	if req.Device != "" {
+		n, err = api.server.PushDevice(req.Uid, req.Device, p)
+	} else {
+		n, err = api.server.PushUser(req.Uid, req.Platform, p)
+	}
+	return pushResult(PushResult{Uid: req.Uid}, n, err)
+}
+
+func (api *pushAPI) pushRoom(req *PushRequest, p *proto.Proto) []PushResult {
+	n, err := api.server.PushRoom(req.Room, p)
+	return pushResult(PushResult{Room: req.Room}, n, err)
+}
+
+func (api *pushAPI) pushAll(req *PushRequest, p *proto.Proto) []PushResult {
+	n := api.server.Broadcast(p, BroadcastOptions{Rate: api.broadcastRate(req.Rate), Platform: req.Platform})
+	return pushResult(PushResult{}, n, nil)
+}
+
+// broadcastRate get the rate of a broadcast request, the config rate
+// protects the network and is never raised by a request.
+func (api *pushAPI) broadcastRate(rate int) int {
+	if api.rate > 0 && (rate <= 0 || rate > api.rate) {
+		return api.rate
+	}
+	return rate
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"im/comet/proto"
+	"im/comet/stat"
+	"im/comet/zone"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func testPush(t *testing.T, url, auth, body string) (code int, results []PushResult) {
+	req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Results []PushResult `json:"results"`
+	}
+	json.NewDecoder(resp.Body).Decode(&res)
+	return resp.StatusCode, res.Results
+}
+
+func TestPushAPI(t *testing.T) {
+	stat.SvrZones = stat.NewZonesStat(2)
+	zones := []*zone.Zone{zone.NewZone(0, zone.ZoneOptions{}), zone.NewZone(1, zone.ZoneOptions{})}
+	server := NewServer(zones, nil, nil, ServerOptions{})
+	var ids []uint64
+	for i := 0; i < 3; i++ {
+		s := zone.NewSession(server.NewId(7, -1), -1, 1, 16)
+		s.Uid = 7
+		s.Device = string(rune('a' + i))
+		// every session of a user is in the zone of uid
+		if s.ZoneId = zone.ZoneOf(s.Id); s.ZoneId != 1 {
+			t.Fatalf("uid 7 zone %d, want 1", s.ZoneId)
+		}
+		server.Zone(s.Id).Put(s, zone.DupLoginAllow)
+		ids = append(ids, s.Id)
+		if i > 0 {
+			server.JoinRoom("live", s)
+		}
+	}
+	ts := httptest.NewServer(newPushMux(server, "k", 0))
+	defer ts.Close()
+
+	if code, _ := testPush(t, ts.URL+"/push/id", "", `{}`); code != 401 {
+		t.Errorf("no auth %d", code)
+	}
+	if code, _ := testPush(t, ts.URL+"/push/id", "Bearer x", `{}`); code != 401 {
+		t.Errorf("bad auth %d", code)
+	}
+	if resp, err := http.Get(ts.URL + "/push/id"); err != nil || resp.StatusCode != 405 {
+		t.Errorf("get %v error(%v)", resp, err)
+	}
+	big := `{"id":1,"body":"` + strings.Repeat("x", 2048) + `"}`
+	if code, _ := testPush(t, ts.URL+"/push/id", "Bearer k", big); code != 413 {
+		t.Errorf("big body %d", code)
+	}
+
+	for _, typ := range []string{`{"id":1}`, `{"id":1,"type":3}`, `{"id":1,"type":2050}`} {
+		if code, _ := testPush(t, ts.URL+"/push/id", "Bearer k", typ); code != 400 {
+			t.Errorf("%s %d", typ, code)
+		}
+	}
+
+	succeed, failed := atomic.LoadUint64(&stat.MsgStat.Succeed), atomic.LoadUint64(&stat.MsgStat.Failed)
+	ids2, _ := json.Marshal([]uint64{ids[0], 1 << 40})
+	cases := []struct {
+		path      string
+		body      string
+		delivered []int
+	}{
+		{"/push/id", `{"id":` + jsonId(ids[0]) + `,"type":1537,"body":{"a":1}}`, []int{1}},
+		{"/push/ids", `{"ids":` + string(ids2) + `,"type":1537}`, []int{1, 0}},
+		{"/push/uid", `{"uid":7,"type":1537}`, []int{3}},
+		{"/push/uid", `{"uid":7,"device":"b","type":1537}`, []int{1}},
+		{"/push/room", `{"room":"live","type":1537}`, []int{2}},
+		{"/push/room", `{"room":"none","type":1537}`, []int{0}},
+		{"/push/all", `{"type":1537}`, []int{3}},
+	}
+	for _, c := range cases {
+		code, results := testPush(t, ts.URL+c.path, "Bearer k", c.body)
+		if code != 200 || len(results) != len(c.delivered) {
+			t.Fatalf("%s %s code %d results %v", c.path, c.body, code, results)
+		}
+		for i, res := range results {
+			if res.Delivered != c.delivered[i] {
+				t.Errorf("%s %s result %d %+v", c.path, c.body, i, res)
+			}
+		}
+	}
+	// 1+1+3+1+2+3 delivered, the unknown id and room failed
+	if d := atomic.LoadUint64(&stat.MsgStat.Succeed) - succeed; d != 11 {
+		t.Errorf("succeed +%d", d)
+	}
+	if d := atomic.LoadUint64(&stat.MsgStat.Failed) - failed; d != 2 {
+		t.Errorf("failed +%d", d)
+	}
+}
+
+func TestPushUserZone(t *testing.T) {
+	stat.SvrZones = stat.NewZonesStat(2)
+	zones := []*zone.Zone{zone.NewZone(0, zone.ZoneOptions{}), zone.NewZone(1, zone.ZoneOptions{})}
+	server := NewServer(zones, nil, nil, ServerOptions{})
+	if zs := server.userZones(7); len(zs) != 1 || zs[0] != zones[1] {
+		t.Fatalf("uid 7 zones %v", zs)
+	}
+	// a zone chosen by the authenticator
+	s := zone.NewSession(server.NewId(7, 0), -1, 1, 16)
+	s.Uid, s.Device = 7, "a"
+	server.Zone(s.Id).Put(s, zone.DupLoginAllow)
+	if n, err := server.PushDevice(7, "a", &proto.Proto{Type: proto.S2C_CALCULATE}); err != nil || n != 1 {
+		t.Fatalf("PushDevice %d error(%v)", n, err)
+	}
+}
+
+func TestPushBroadcastRate(t *testing.T) {
+	for _, c := range []struct{ config, req, rate int }{
+		{0, 0, 0},
+		{0, 100, 100},
+		{100, 0, 100},
+		{100, 10, 10},
+		{100, 1000, 100},
+	} {
+		if rate := (&pushAPI{rate: c.config}).broadcastRate(c.req); rate != c.rate {
+			t.Errorf("config %d request %d rate %d, want %d", c.config, c.req, rate, c.rate)
+		}
+	}
+}
+
+func jsonId(id uint64) string {
+	b, _ := json.Marshal(id)
+	return string(b)
+}
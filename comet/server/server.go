@@ -1,10 +1,22 @@
 package server
 
 import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
 	"im/comet/handle"
+	"im/comet/proto"
+	"im/comet/stat"
 	"im/comet/utils"
 	"im/comet/zone"
 	"im/pkg/log"
+	inet "im/pkg/net"
+	"im/pkg/net/proxyproto"
+	itime "im/pkg/time"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,40 +27,366 @@ var (
 	DefaultWhitelist *Whitelist
 )
 
+// S2C_KICKED body, shared by all kicked sessions
+var kickedDupLoginBody, _ = json.Marshal(&proto.Kicked{Code: proto.KICK_DUP_LOGIN, Msg: "login elsewhere"})
+
 type ServerOptions struct {
+	NodeId           int
 	CliProto         int
 	SvrProto         int
 	HandshakeTimeout time.Duration
+	WriteTimeout     time.Duration // 0 no deadline
+	Overflow         int           // zone.Overflow* policy
+	DupLogin         int           // zone.DupLogin* policy
 	TCPKeepalive     bool
 	TCPRcvbufSize    int
 	TCPSndbufSize    int
+	TCPReusePort     bool       // a SO_REUSEPORT listener per accept loop
+	MaxConn          int        // 0 unlimited
+	ProxyTCP         bool       // PROXY protocol header before tcp clients
+	ProxyWebsocket   bool       // PROXY protocol header before websocket clients
+	ProxyTrusted     inet.CIDRs // proxy sources trusted, empty trust none
+	Authenticator    Authenticator
+	Access           *AccessControl // nil accept all
+	Websocket        WebsocketOptions
 }
 
 type Server struct {
-	Zones   []*zone.Zone // subkey bucket
-	round   *utils.Round // accept round store
-	handle  []handle.Handle
-	Options ServerOptions
+	Zones    []*zone.Zone  // subkey bucket
+	Rooms    []*zone.Rooms // room registry shards, as many as the zones
+	round    *utils.Round  // accept round store
+	router   *handle.Router
+	upgrader *websocket.Upgrader
+	origins  []string // lowered websocket origin patterns
+	Options  ServerOptions
+	seq      uint32 // node session sequence
+	// 1 while every session is in the zone of its uid
+	userZoned int32
+
+	lock      sync.Mutex
+	closing   bool
+	listeners []net.Listener
+	https     []*http.Server
+	certs     []*CertReloader
+	polls     map[string]*pollSession // by token
+	pollLock  sync.Mutex
+	wg        sync.WaitGroup // dispatch goroutines
+
+	// runtime options, changed by setters
+	handshake int64
+	write     int64
+	overflow  int64
+	dupLogin  int64
+	maxConn   int64
+	conns     int64
 }
 
 // NewServer returns a new Server.
-func NewServer(z []*zone.Zone, r *utils.Round, h []handle.Handle, options ServerOptions) *Server {
+func NewServer(z []*zone.Zone, r *utils.Round, h *handle.Router, options ServerOptions) *Server {
 	s := new(Server)
 	s.Zones = z
+	s.Rooms = make([]*zone.Rooms, len(z))
+	for i := range s.Rooms {
+		s.Rooms[i] = zone.NewRooms()
+	}
 	s.round = r
-	s.handle = h
+	s.router = h
+	s.origins = lowerOrigins(options.Websocket.Origins)
+	s.upgrader = newUpgrader(options.Websocket, s.origins)
+	s.polls = make(map[string]*pollSession)
+	s.userZoned = 1
 	s.Options = options
+	s.handshake = int64(options.HandshakeTimeout)
+	s.write = int64(options.WriteTimeout)
+	s.overflow = int64(options.Overflow)
+	s.dupLogin = int64(options.DupLogin)
+	s.maxConn = int64(options.MaxConn)
 	return s
 }
 
+// HandshakeTimeout get the deadline for init handshake.
+func (server *Server) HandshakeTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&server.handshake))
+}
+
+// SetHandshakeTimeout change the handshake deadline of new connections.
+func (server *Server) SetHandshakeTimeout(d time.Duration) {
+	atomic.StoreInt64(&server.handshake, int64(d))
+}
+
+// WriteTimeout get the deadline for every flush to a session.
+func (server *Server) WriteTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&server.write))
+}
+
+// SetWriteTimeout change the deadline for every flush.
+func (server *Server) SetWriteTimeout(d time.Duration) {
+	atomic.StoreInt64(&server.write, int64(d))
+}
+
+// SetOverflow change the overflow policy of new sessions.
+func (server *Server) SetOverflow(policy int) {
+	atomic.StoreInt64(&server.overflow, int64(policy))
+}
+
+// SetDupLogin change the duplicate login policy of new sessions.
+func (server *Server) SetDupLogin(policy int) {
+	atomic.StoreInt64(&server.dupLogin, int64(policy))
+}
+
+// SetMaxConn change the max connections, 0 unlimited. alive connections
+// beyond the limit are not closed.
+func (server *Server) SetMaxConn(n int) {
+	atomic.StoreInt64(&server.maxConn, int64(n))
+}
+
+// acquire count a new connection, false if the max connections reached.
+func (server *Server) acquire() bool {
+	max := atomic.LoadInt64(&server.maxConn)
+	if n := atomic.AddInt64(&server.conns, 1); max > 0 && n > max {
+		atomic.AddInt64(&server.conns, -1)
+		return false
+	}
+	return true
+}
+
+// release uncount a connection acquired.
+func (server *Server) release() {
+	atomic.AddInt64(&server.conns, -1)
+}
+
+// NewId alloc a session id for uid in zone zid, see zone.EncodeId. if zid < 0
+// the zone of uid is used. A zone chosen otherwise must be a function of the
+// uid, the duplicate login policy looks only in the zone of the session.
+func (server *Server) NewId(uid uint32, zid int) uint64 {
+	if zid < 0 || zid >= len(server.Zones) {
+		zid = server.userZoneId(uid)
+	} else if zid != server.userZoneId(uid) {
+		atomic.StoreInt32(&server.userZoned, 0)
+	}
+	seq := uint16(atomic.AddUint32(&server.seq, 1))
+	return zone.EncodeId(server.Options.NodeId, zid, seq, uid)
+}
+
+// userZoneId get the default zone of uid, all sessions of one user share it.
+func (server *Server) userZoneId(uid uint32) int {
+	return int(uid % uint32(len(server.Zones)))
+}
+
+// userZones get the zones the sessions of uid may be in, only the zone of uid
+// unless the authenticator chose another zone for any session.
+func (server *Server) userZones(uid uint32) []*zone.Zone {
+	if atomic.LoadInt32(&server.userZoned) == 0 {
+		return server.Zones
+	}
+	zid := server.userZoneId(uid)
+	return server.Zones[zid : zid+1]
+}
+
+// Zone get the zone of the session id, nil if the id is not in any zone.
 func (server *Server) Zone(id uint64) *zone.Zone {
-	zid := uint8(id >> 56)
+	zid := zone.ZoneOf(id)
 	log.Debug("%v hit zone index: %d", id, zid)
+	if zid >= len(server.Zones) {
+		return nil
+	}
 	return server.Zones[zid]
 }
 
 func (server *Server) Disconect(id uint64) error {
-	zid := uint8(id >> 56)
-	server.Zones[zid].Del(id)
+	if z := server.Zone(id); z != nil {
+		z.Del(id)
+	}
 	return nil
 }
+
+// bind bind the handshake result to the session.
+func (server *Server) bind(sion *zone.Session, id uint64, ident Identity, addr string, conn io.Closer) {
+	sion.Id = id
+	sion.ZoneId = zone.ZoneOf(id)
+	sion.Uid = ident.Uid
+	sion.Device = ident.Device
+	sion.Platform = ident.Platform
+	sion.Meta = ident.Meta
+	sion.Addr = addr
+	sion.Conn = conn
+	sion.Overflow = int(atomic.LoadInt64(&server.overflow))
+}
+
+// login put the bound session into its zone by the duplicate login policy,
+// the kicked sessions get a S2C_KICKED notice before closed. Refused once
+// closing, the sessions Shutdown notices are taken after closing is set.
+func (server *Server) login(sion *zone.Session) (err error) {
+	var (
+		kicked []*zone.Session
+		z      = server.Zone(sion.Id)
+	)
+	if server.Closing() {
+		return ErrServerClosing
+	}
+	if kicked, err = z.Put(sion, int(atomic.LoadInt64(&server.dupLogin))); err != nil {
+		return
+	}
+	for _, old := range kicked {
+		log.Info("id: %v kicked by id: %v login from %s", old.Id, sion.Id, sion.Addr)
+		// the old client may be gone with a full cache, never wait it
+		old.Finish(&proto.Proto{Type: proto.S2C_KICKED, Body: kickedDupLoginBody})
+	}
+	if server.Closing() {
+		// closed meanwhile, maybe after the sessions were taken
+		z.Del(sion.Id)
+		err = ErrServerClosing
+	}
+	return
+}
+
+// proxyListener wrap the websocket listener if the PROXY protocol opened,
+// the header read is bounded by the handshake timeout.
+func (server *Server) proxyListener(l net.Listener) net.Listener {
+	if !server.Options.ProxyWebsocket {
+		return l
+	}
+	return &proxyproto.Listener{Listener: l, Trusted: server.Options.ProxyTrusted, Timeout: server.HandshakeTimeout()}
+}
+
+// writeDeadline set the write deadline of conn for the next flush.
+func (server *Server) writeDeadline(conn interface {
+	SetWriteDeadline(t time.Time) error
+}) {
+	var t time.Time
+	if d := server.WriteTimeout(); d > 0 {
+		t = time.Now().Add(d)
+	}
+	conn.SetWriteDeadline(t)
+}
+
+// serveRead read and handle the protos of a logged in session until an error,
+// read is the transport read. network names the transport in the logs.
+func (server *Server) serveRead(ctx *handle.Context, read func(p *proto.Proto) error, tr *itime.Timer, trd *itime.TimerData, heartbeat time.Duration, network string) (err error) {
+	var (
+		p    *proto.Proto
+		sion = ctx.Session
+	)
+	for {
+		if p, err = sion.CliProto.Set(); err != nil {
+			log.Error("id: %v serve %s cliproto.Set error(%v)", sion.Id, network, err)
+			return
+		}
+		if err = read(p); err != nil {
+			log.Error("id: %v serve %s read error(%v)", sion.Id, network, err)
+			return
+		}
+		if err = server.handleProto(ctx, p, tr, trd, heartbeat); err != nil {
+			log.Error("id: %v, server handle proto %v error(%v)", sion.Id, p, err)
+			return
+		}
+	}
+}
+
+// handleProto handle p read into the CliProto slot of the context session,
+// the reply is signaled to the dispatch unless async. A heartbeat refresh
+// the expire timer.
+func (server *Server) handleProto(ctx *handle.Context, p *proto.Proto, tr *itime.Timer, trd *itime.TimerData, heartbeat time.Duration) (err error) {
+	trace(ctx.Session, "read", p)
+	// handle turns p into the reply
+	ctx.Reset(p)
+	if err = server.router.Handle(ctx); err != nil {
+		return
+	}
+	if ctx.Type == proto.C2S_HEART_BEAT {
+		tr.Set(trd, heartbeat)
+	}
+	// async reply is pushed later, reuse the proto
+	if !ctx.IsAsync() {
+		ctx.Session.CliProto.SetAdv()
+		ctx.Session.Signal()
+	}
+	return
+}
+
+// writeError count the write error, a timeout means a slow client.
+func writeError(err error) {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		stat.SlowStat.IncrWriteTimeout()
+	}
+}
+
+// Push push p to the session id.
+func (server *Server) Push(id uint64, p *proto.Proto) error {
+	z := server.Zone(id)
+	if z == nil {
+		return zone.ErrSessionNotFound
+	}
+	return z.Push(id, p)
+}
+
+// PushUser push p to every session of uid, only the ones on platform if it
+// is not empty. Returns the number of sessions queued it.
+func (server *Server) PushUser(uid uint32, platform string, p *proto.Proto) (n int, e error) {
+	e = zone.ErrSessionNotFound
+	for _, z := range server.userZones(uid) {
+		if zn, ze := z.PushUser(uid, platform, p); ze == nil {
+			n += zn
+			e = nil
+		}
+	}
+	return
+}
+
+// PushDevice push p to the sessions of uid on device. Returns the number of
+// sessions queued it.
+func (server *Server) PushDevice(uid uint32, device string, p *proto.Proto) (n int, e error) {
+	e = zone.ErrSessionNotFound
+	for _, z := range server.userZones(uid) {
+		if zn, ze := z.PushDevice(uid, device, p); ze == nil {
+			n += zn
+			e = nil
+		}
+	}
+	return
+}
+
+// roomShard get the registry shard of room id.
+func (server *Server) roomShard(id string) *zone.Rooms {
+	return server.Rooms[zone.RoomIndex(id, len(server.Rooms))]
+}
+
+// Room get the room id, nil if nobody is in.
+func (server *Server) Room(id string) *zone.Room {
+	return server.roomShard(id).Room(id)
+}
+
+// JoinRoom put the session into room id, returns the members online.
+func (server *Server) JoinRoom(id string, s *zone.Session) (online int, e error) {
+	return server.roomShard(id).Join(id, s)
+}
+
+// LeaveRoom remove the session from room id.
+func (server *Server) LeaveRoom(id string, s *zone.Session) error {
+	return server.roomShard(id).Leave(id, s)
+}
+
+// PushRoom push p to every member of room id, returns the number of members
+// queued it.
+func (server *Server) PushRoom(id string, p *proto.Proto) (n int, e error) {
+	room := server.Room(id)
+	if room == nil {
+		return 0, zone.ErrRoomNotFound
+	}
+	return room.Push(p), nil
+}
+
+// Kick close the session id.
+func (server *Server) Kick(id uint64) (e error) {
+	var (
+		s *zone.Session
+		z = server.Zone(id)
+	)
+	if z == nil {
+		return zone.ErrSessionNotFound
+	}
+	if s, e = z.Session(id); e != nil {
+		return
+	}
+	return s.Kick()
+}
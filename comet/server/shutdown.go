@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"im/comet/proto"
+	"im/pkg/log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ErrServerClosing = errors.New("server closing")
+)
+
+// addListener register a listener closed by Shutdown.
+func (server *Server) addListener(l net.Listener) {
+	server.lock.Lock()
+	server.listeners = append(server.listeners, l)
+	server.lock.Unlock()
+}
+
+// addHTTPServer register a http server closed by Shutdown.
+func (server *Server) addHTTPServer(s *http.Server) {
+	server.lock.Lock()
+	server.https = append(server.https, s)
+	server.lock.Unlock()
+}
+
+// addCertReloader register a key pair reloaded by ReloadCerts.
+func (server *Server) addCertReloader(r *CertReloader) {
+	server.lock.Lock()
+	server.certs = append(server.certs, r)
+	server.lock.Unlock()
+}
+
+// ReloadCerts reload all tls key pairs.
+func (server *Server) ReloadCerts() {
+	server.lock.Lock()
+	certs := server.certs
+	server.lock.Unlock()
+	for _, r := range certs {
+		r.Reload()
+	}
+}
+
+// Closing report the server is shutting down.
+func (server *Server) Closing() (closing bool) {
+	server.lock.Lock()
+	closing = server.closing
+	server.lock.Unlock()
+	return
+}
+
+// track count a connection into the dispatch goroutines Shutdown waits,
+// before its handshake. False once closing, the connection is refused.
+func (server *Server) track() (ok bool) {
+	server.lock.Lock()
+	if ok = !server.closing; ok {
+		server.wg.Add(1)
+	}
+	server.lock.Unlock()
+	return
+}
+
+// Shutdown stop all listeners and refuse new logins, notice every session to
+// reconnect another comet, then wait the dispatch goroutines and the http
+// requests held (long polling and server-sent events) flush until timeout.
+// It returns false if sessions are still alive after timeout.
+func (server *Server) Shutdown(timeout time.Duration) (ok bool) {
+	var (
+		err   error
+		https []*http.Server
+		hwg   sync.WaitGroup
+		done  = make(chan struct{})
+	)
+	server.lock.Lock()
+	server.closing = true
+	for _, l := range server.listeners {
+		if err = l.Close(); err != nil {
+			log.Error("listener.Close(\"%s\") error(%v)", l.Addr(), err)
+		}
+	}
+	https = server.https
+	server.listeners = nil
+	server.https = nil
+	server.lock.Unlock()
+	// stop accepting, the requests held get the notice before closed
+	for _, s := range https {
+		hwg.Add(1)
+		go func(s *http.Server) {
+			s.Shutdown(context.Background())
+			hwg.Done()
+		}(s)
+	}
+
+	go func() {
+		// shared by all sessions, body must not be nil
+		p := &proto.Proto{Type: proto.S2C_RECONNECT, Body: emptyJSONBody}
+		for _, z := range server.Zones {
+			z.PushAll(p)
+			z.Close()
+		}
+		server.wg.Wait()
+		hwg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		ok = true
+	case <-time.After(timeout):
+	}
+	for _, s := range https {
+		if err = s.Close(); err != nil {
+			log.Error("http server.Close() error(%v)", err)
+		}
+	}
+	return
+}
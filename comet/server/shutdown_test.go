@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"im/comet/proto"
+	"im/comet/zone"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	server := newTestServer(ServerOptions{Websocket: WebsocketOptions{PollTimeout: 2 * time.Second}})
+	mux := http.NewServeMux()
+	server.handlePoll(mux)
+	mux.HandleFunc("/sse", server.ServeSSE)
+	ts := httptest.NewUnstartedServer(mux)
+	server.addHTTPServer(ts.Config)
+	ts.Start()
+	defer ts.Close()
+
+	// a server-sent events stream and a held poll
+	resp, err := http.Get(fmt.Sprintf("%s/sse?uid=8&token=%s", ts.URL, testAuth.Sign(8, time.Now().Add(time.Minute))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	testSSEEvent(t, r)
+	token := testPollAuth(t, ts.URL, 9, "")
+	polled := make(chan []proto.Proto, 1)
+	go func() { polled <- testPollDo(t, "GET", ts.URL+"/poll?token="+token, nil, 200) }()
+	time.Sleep(50 * time.Millisecond)
+
+	if !server.Shutdown(2 * time.Second) {
+		t.Fatal("shutdown timeout")
+	}
+	// both got the notice before closed
+	if lines := testSSEEvent(t, r); strings.Join(lines, "|") != fmt.Sprintf("event: %d|data: {}", proto.S2C_RECONNECT) {
+		t.Fatalf("sse notice %v", lines)
+	}
+	if ps := <-polled; len(ps) != 1 || ps[0].Type != proto.S2C_RECONNECT {
+		t.Fatalf("poll notice %v", ps)
+	}
+	// no login once closing
+	p := &proto.Proto{Type: proto.C2S_AUTH, Body: testAuthBody(10, "")}
+	if _, err = server.connect(p, zone.NewSession(0, -1, 4, 4), "late", nil, nil); err != ErrServerClosing || p.Type != proto.S2C_RECONNECT {
+		t.Fatalf("late login %v error(%v)", p, err)
+	}
+	if _, err = server.PushUser(10, "", &proto.Proto{Type: proto.S2C_CALCULATE}); err != zone.ErrSessionNotFound {
+		t.Fatalf("late session push error(%v)", err)
+	}
+	if server.track() {
+		t.Fatal("connection tracked once closing")
+	}
+}
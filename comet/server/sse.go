@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"im/comet/proto"
+	"im/comet/zone"
+	"im/pkg/log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// client reconnect delay, ms
+	sseRetry = 3000
+)
+
+var (
+	// comment line to find dead clients, nothing else is written for long
+	ssePingInterval = 15 * time.Second
+)
+
+// sseConn is closed by Kick, the stream ends at the next ProtoFinish.
+type sseConn struct {
+	sion *zone.Session
+}
+
+func (c *sseConn) Close() error {
+	c.sion.Discard()
+	return nil
+}
+
+// ServeSSE stream the pushes of a receive only session as server-sent
+// events, authenticated by the query:
+//
+//	GET /sse?uid=&token=&device=&platform=
+//
+// every proto is an event, id is the seq if not 0, event the type and data
+// the json body. Every write and flush must be done in the write timeout.
+// Last-Event-ID of a reconnecting client is kept in the session meta as
+// "last_event_id", comet can't replay, the backend or a handler resends.
+func (server *Server) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		uid    uint64
+		p      *proto.Proto
+		meta   map[string]string
+		finish bool
+		sion   = zone.NewSession(0, -1, server.Options.CliProto, server.Options.SvrProto)
+		q      = r.URL.Query()
+		rc     = http.NewResponseController(w)
+	)
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	if !checkOrigin(r, server.origins) {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	if uid, err = strconv.ParseUint(q.Get("uid"), 10, 32); err != nil {
+		http.Error(w, "Bad Request", 400)
+		return
+	}
+	if !server.acquire() {
+		log.Warn("max conn reached, reject %s", r.RemoteAddr)
+		http.Error(w, "Service Unavailable", 503)
+		return
+	}
+	defer server.release()
+	p = &proto.Proto{Type: proto.C2S_AUTH}
+	p.Body, _ = json.Marshal(&proto.Auth{Uid: uint32(uid), Code: q.Get("token"), Device: q.Get("device"), Platform: q.Get("platform")})
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		meta = map[string]string{"last_event_id": id}
+	}
+	if _, err = server.connect(p, sion, r.RemoteAddr, &sseConn{sion: sion}, meta); err != nil {
+		log.Error("sse handshake failed error(%v)", err)
+		if err == ErrServerClosing {
+			http.Error(w, "Service Unavailable", 503)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(401)
+		w.Write(p.Body)
+		return
+	}
+	log.Debug("start sse serve %s id: %v", r.RemoteAddr, sion.Id)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	server.writeDeadline(rc)
+	if _, err = fmt.Fprintf(w, "retry: %d\n\n", sseRetry); err == nil {
+		err = rc.Flush()
+	}
+	// wake the stream up once the client is gone
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			sion.Discard()
+		case <-done:
+		}
+	}()
+	for err == nil && !finish {
+		switch p = sion.ReadyTimeout(ssePingInterval); p {
+		case nil:
+			server.writeDeadline(rc)
+			_, err = fmt.Fprint(w, ":\n\n")
+		case proto.ProtoFinish:
+			finish = true
+			continue
+		case proto.ProtoReady:
+			// receive only, nothing sent by the client
+			continue
+		default:
+			trace(sion, "write", p)
+			server.writeDeadline(rc)
+			if p.Type == proto.PROTO_RAW {
+				for _, ph := range p.RawProtos() {
+					if err = writeSSE(w, &ph); err != nil {
+						break
+					}
+				}
+			} else {
+				err = writeSSE(w, p)
+			}
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+	}
+	if err != nil {
+		writeError(err)
+		log.Error("id: %v serve sse error(%v)", sion.Id, err)
+	}
+	if err = server.Disconect(sion.Id); err != nil {
+		log.Error("id: %v do disconnect error(%v)", sion.Id, err)
+	}
+	sion.Discard()
+}
+
+// writeSSE write p as an event, a multi-line body is split into data lines.
+func writeSSE(w http.ResponseWriter, p *proto.Proto) (err error) {
+	body := p.Body
+	if len(body) == 0 {
+		body = emptyJSONBody
+	}
+	if p.SeqId != 0 {
+		// no id keeps the last one of the client
+		if _, err = fmt.Fprintf(w, "id: %d\n", p.SeqId); err != nil {
+			return
+		}
+	}
+	if _, err = fmt.Fprintf(w, "event: %d\n", p.Type); err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		if _, err = fmt.Fprintf(w, "data: %s\n", line); err != nil {
+			return
+		}
+	}
+	_, err = fmt.Fprint(w, "\n")
+	return
+}
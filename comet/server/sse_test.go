@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"im/comet/proto"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSSEEvent read the lines of an event until the blank one.
+func testSSEEvent(t *testing.T, r *bufio.Reader) (lines []string) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event %v error(%v)", lines, err)
+		}
+		if line = strings.TrimSuffix(line, "\n"); line == "" {
+			return
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestSSE(t *testing.T) {
+	ssePingInterval = 50 * time.Millisecond
+	defer func() { ssePingInterval = 15 * time.Second }()
+	server := newTestServer(ServerOptions{WriteTimeout: time.Second})
+	ts := httptest.NewServer(http.HandlerFunc(server.ServeSSE))
+	defer ts.Close()
+	url := fmt.Sprintf("%s/sse?uid=%d&token=%s&device=d1", ts.URL, 5, testAuth.Sign(5, time.Now().Add(time.Minute)))
+
+	// a bad token is rejected
+	resp, err := http.Get(fmt.Sprintf("%s/sse?uid=5&token=bad", ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Fatalf("bad token code %d", resp.StatusCode)
+	}
+
+	if resp, err = http.Get(url); err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("sse code %d type %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	r := bufio.NewReader(resp.Body)
+	if lines := testSSEEvent(t, r); len(lines) != 1 || lines[0] != "retry: 3000" {
+		t.Fatalf("retry %v", lines)
+	}
+
+	// nothing pushed, a ping comment
+	if lines := testSSEEvent(t, r); len(lines) != 1 || lines[0] != ":" {
+		t.Fatalf("ping %v", lines)
+	}
+
+	// an event without seq has no id
+	if n, err := server.PushUser(5, "", &proto.Proto{Type: proto.S2C_CALCULATE, Body: []byte("{\"a\":1,\n\"b\":2}")}); err != nil || n != 1 {
+		t.Fatalf("PushUser %d error(%v)", n, err)
+	}
+	lines := testSSEEvent(t, r)
+	for lines[0] == ":" {
+		lines = testSSEEvent(t, r)
+	}
+	if want := fmt.Sprintf("event: %d|data: {\"a\":1,|data: \"b\":2}", proto.S2C_CALCULATE); strings.Join(lines, "|") != want {
+		t.Fatalf("event %v, want %s", lines, want)
+	}
+	var id uint64
+	for _, z := range server.Zones {
+		for _, sion := range z.Sessions() {
+			id = sion.Id
+		}
+	}
+	if err = server.Push(id, &proto.Proto{Type: proto.S2C_CALCULATE, SeqId: 7, Body: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if lines = testSSEEvent(t, r); lines[0] == ":" {
+		lines = testSSEEvent(t, r)
+	}
+	if want := fmt.Sprintf("id: 7|event: %d|data: {}", proto.S2C_CALCULATE); strings.Join(lines, "|") != want {
+		t.Fatalf("event %v, want %s", lines, want)
+	}
+
+	// a reconnect of the same device kicks the stream, the last event id is
+	// kept for the backend
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Last-Event-ID", "7")
+	resp2, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp2.Body.Close()
+	if lines := testSSEEvent(t, bufio.NewReader(resp2.Body)); len(lines) != 1 {
+		t.Fatalf("reconnect retry %v", lines)
+	}
+	var n int
+	for _, z := range server.Zones {
+		for _, sion := range z.Sessions() {
+			if sion.Id != id && sion.Meta["last_event_id"] == "7" {
+				n++
+			}
+		}
+	}
+	if n != 1 {
+		t.Fatalf("%d sessions with the last event id", n)
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				close(done)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("kicked stream not ended")
+	}
+}
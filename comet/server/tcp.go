@@ -1,43 +1,69 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
+	"im/comet/handle"
 	"im/comet/proto"
+	"im/comet/utils"
 	"im/comet/zone"
 	"im/pkg/bufio"
 	"im/pkg/bytes"
 	"im/pkg/log"
+	inet "im/pkg/net"
+	"im/pkg/net/proxyproto"
 	itime "im/pkg/time"
 	"net"
-	"time"
-	"encoding/json"
-	"math/rand"
-	"math"
 	"im/comet/stat"
 )
 
 // InitTCP listen all tcp.bind and start accept connections.
 func InitTCP(addrs []string, accept int) (err error) {
+	return initTCP(addrs, accept, nil)
+}
+
+// InitTCPWithTLS listen all tcp.tls_bind and start accept tls connections,
+// the key pair is reloaded on files change or Server.ReloadCerts.
+func InitTCPWithTLS(addrs []string, accept int, cert, priv string) (err error) {
+	var r *CertReloader
+	if r, err = NewCertReloader(cert, priv); err != nil {
+		return
+	}
+	DefaultServer.addCertReloader(r)
+	return initTCP(addrs, accept, r.TLSConfig())
+}
+
+func initTCP(addrs []string, accept int, config *tls.Config) (err error) {
 	var (
-		bind     string
-		listener *net.TCPListener
-		addr     *net.TCPAddr
+		i         int
+		bind      string
+		listener  net.Listener
+		listeners []net.Listener
 	)
 	for _, bind = range addrs {
-		if addr, err = net.ResolveTCPAddr("tcp4", bind); err != nil {
-			log.Error("net.ResolveTCPAddr(tcp4, %s) error(%v)\n", bind, err)
-			return
+		if DefaultServer.Options.TCPReusePort {
+			// one listener and round slice per accept loop
+			if listeners, err = inet.ListenReusePort(bind, accept); err != nil {
+				log.Error("inet.ListenReusePort(\"%s\", %d) error(%v)", bind, accept, err)
+				return
+			}
+			for i, listener = range listeners {
+				DefaultServer.addListener(listener)
+				go acceptTCP(DefaultServer, listener, DefaultServer.round.Slice(i, accept), config)
+			}
+			log.Debug("start tcp reuseport listen: %s:%d\n", bind, accept)
+			continue
 		}
-
-		if listener, err = net.ListenTCP("tcp4", addr); err != nil {
-			log.Error("net.ListenTCP(tcp4, %s) error(%v)\n", bind, err)
+		if listener, err = inet.Listen(bind); err != nil {
+			log.Error("inet.Listen(\"%s\") error(%v)", bind, err)
 			return
 		}
 
+		DefaultServer.addListener(listener)
 		log.Debug("start tcp listen: %s:%d\n", bind, accept)
 		// split N core accept
-		for i := 0; i < accept; i++ {
-			go acceptTCP(DefaultServer, listener)
+		for i = 0; i < accept; i++ {
+			go acceptTCP(DefaultServer, listener, DefaultServer.round, config)
 		}
 	}
 	return
@@ -46,82 +72,122 @@ func InitTCP(addrs []string, accept int) (err error) {
 // Accept accepts connections on the listener and serves requests
 // for each incoming connection.  Accept blocks; the caller typically
 // invokes it in a go statement.
-func acceptTCP(server *Server, lis *net.TCPListener) {
+func acceptTCP(server *Server, lis net.Listener, round *utils.Round, config *tls.Config) {
 	var (
-		conn *net.TCPConn
+		conn net.Conn
 		err  error
 		r    int
 	)
 	for {
-		if conn, err = lis.AcceptTCP(); err != nil {
+		if conn, err = lis.Accept(); err != nil {
 			// if listener close then return
+			if server.Closing() {
+				return
+			}
 			log.Error("listener.Accept(\"%s\") error(%v)", lis.Addr().String(), err)
 			return
 		}
-		if err = conn.SetKeepAlive(server.Options.TCPKeepalive); err != nil {
-			log.Error("conn.SetKeepAlive() error(%v)", err)
-			return
+		// the client address of a proxied conn is checked after the header
+		if !server.Options.ProxyTCP && !server.allowed(conn.RemoteAddr()) {
+			log.Warn("access rejected %s", conn.RemoteAddr())
+			conn.Close()
+			continue
 		}
-		if err = conn.SetReadBuffer(server.Options.TCPRcvbufSize); err != nil {
-			log.Error("conn.SetReadBuffer() error(%v)", err)
-			return
+		if !server.acquire() {
+			log.Warn("max conn reached, reject %s", conn.RemoteAddr())
+			conn.Close()
+			continue
 		}
-		if err = conn.SetWriteBuffer(server.Options.TCPSndbufSize); err != nil {
-			log.Error("conn.SetWriteBuffer() error(%v)", err)
-			return
+		// unix socket conns have no tcp options
+		if tc, ok := conn.(*net.TCPConn); ok {
+			if err = server.setTCPOptions(tc); err != nil {
+				conn.Close()
+				server.release()
+				continue
+			}
 		}
 
-		go serveTCP(server, conn, r)
+		go serveTCP(server, conn, round, r, config)
 		if r++; r == maxInt {
 			r = 0
 		}
 	}
 }
 
-func serveTCP(server *Server, conn *net.TCPConn, r int) {
+func (server *Server) setTCPOptions(conn *net.TCPConn) (err error) {
+	if err = conn.SetKeepAlive(server.Options.TCPKeepalive); err != nil {
+		log.Error("conn.SetKeepAlive() error(%v)", err)
+		return
+	}
+	if err = conn.SetReadBuffer(server.Options.TCPRcvbufSize); err != nil {
+		log.Error("conn.SetReadBuffer() error(%v)", err)
+		return
+	}
+	if err = conn.SetWriteBuffer(server.Options.TCPSndbufSize); err != nil {
+		log.Error("conn.SetWriteBuffer() error(%v)", err)
+	}
+	return
+}
+
+func serveTCP(server *Server, conn net.Conn, round *utils.Round, r int, config *tls.Config) {
 	var (
 		// timer
-		tr = server.round.Timer(r)
-		rp = server.round.Reader(r)
-		wp = server.round.Writer(r)
-		// ip addr
-		lAddr = conn.LocalAddr().String()
-		rAddr = conn.RemoteAddr().String()
+		tr = round.Timer(r)
+		rp = round.Reader(r)
+		wp = round.Writer(r)
 	)
 
-	log.Debug("start tcp serve %s with %s", lAddr, rAddr)
-	server.serveTCP(conn, rp, wp, tr)
+	server.serveTCP(conn, rp, wp, tr, config)
+	server.release()
 }
 
 // TODO linger close?
-func (server *Server) serveTCP(conn *net.TCPConn, rp, wp *bytes.Pool, tr *itime.Timer) {
+func (server *Server) serveTCP(conn net.Conn, rp, wp *bytes.Pool, tr *itime.Timer, config *tls.Config) {
 	var (
-		err  error
-		id   uint64
-		hb   time.Duration // heartbeat
-		p    *proto.Proto
-		z    *zone.Zone
-		trd  *itime.TimerData
-		rb   = rp.Get()
-		wb   = wp.Get()
-		sion = zone.NewSession(0, -1, server.Options.CliProto, server.Options.SvrProto)
-		rr   = &sion.Reader
-		wr   = &sion.Writer
+		err   error
+		id    uint64
+		ident Identity
+		p     *proto.Proto
+		z     *zone.Zone
+		trd   *itime.TimerData
+		ctx   *handle.Context
+		rb    *bytes.Buffer
+		wb    *bytes.Buffer
+		sion  = zone.NewSession(0, -1, server.Options.CliProto, server.Options.SvrProto)
+		rr    = &sion.Reader
+		wr    = &sion.Writer
 	)
 
-	sion.Reader.ResetBuffer(conn, rb.Bytes())
-	sion.Writer.ResetBuffer(conn, wb.Bytes())
-
 	// handshake
-	trd = tr.Add(server.Options.HandshakeTimeout, func() {
+	trd = tr.Add(server.HandshakeTimeout(), func() {
 		conn.Close()
 	})
 
+	if conn, err = server.wrapTCP(conn, config); err != nil {
+		log.Error("%s tcp handshake error(%v)", conn.RemoteAddr(), err)
+		conn.Close()
+		tr.Del(trd)
+		return
+	}
+	// waited by Shutdown from now on
+	if !server.track() {
+		log.Warn("server closing, reject %s", conn.RemoteAddr())
+		conn.Close()
+		tr.Del(trd)
+		return
+	}
+	rb = rp.Get()
+	wb = wp.Get()
+	log.Debug("start tcp serve %s with %s", conn.LocalAddr(), conn.RemoteAddr())
+
+	sion.Reader.ResetBuffer(conn, rb.Bytes())
+	sion.Writer.ResetBuffer(conn, wb.Bytes())
+
 	// must not setadv, only used in auth
 	if p, err = sion.CliProto.Set(); err == nil {
-		if id, sion.ZoneId, hb, err = server.authTCP(rr, wr, p); err == nil {
+		if ident, err = server.authTCP(rr, wr, p, sion, conn); err == nil {
+			id = sion.Id
 			z = server.Zone(id)
-			z.Put(sion)
 		}
 	}
 
@@ -130,46 +196,20 @@ func (server *Server) serveTCP(conn *net.TCPConn, rp, wp *bytes.Pool, tr *itime.
 		rp.Put(rb)
 		wp.Put(wb)
 		tr.Del(trd)
-		log.Error("key: %s handshake failed error(%v)", id, err)
+		server.wg.Done()
+		log.Error("key: %v handshake failed error(%v)", id, err)
 		return
 	}
 
 	trd.Key = id
-	tr.Set(trd, hb)
+	tr.Set(trd, ident.Heartbeat)
 
-	// hanshake ok start dispatch goroutine
+	// handshake ok start dispatch goroutine
 	go server.dispatchTCP(id, conn, wr, wp, wb, sion)
+	ctx = handle.NewContext(server, sion)
 	stat.RStat.IncRead()
 	defer stat.RStat.DescRead()
-	for {
-		if p, err = sion.CliProto.Set(); err != nil {
-			log.Error("id: %v serve tcp cliptoto.Set error(%v)", id, err)
-			break
-		}
-
-		if err = p.ReadTCP(rr); err != nil {
-			log.Error("id: %v serve tcp read tcp error(%v)", id, err)
-			break
-		}
-
-		if int(p.Type) >= len(server.handle) {
-			log.Error("id: %v, server tcp invalid proto %v", id, p.Type)
-			break
-		}
-
-		// TODO handle proto msg
-		if err = server.handle[p.Type](id, p); err != nil {
-			log.Error("id: %v, server handle proto %v", id, p)
-			break
-		}
-
-		if p.Type == proto.C2S_HEART_BEAT { // heart beat set expired
-			tr.Set(trd, hb)
-		}
-
-		sion.CliProto.SetAdv()
-		sion.Signal()
-	}
+	err = server.serveRead(ctx, func(p *proto.Proto) error { return p.ReadTCP(rr) }, tr, trd, ident.Heartbeat, "tcp")
 
 	z.Del(id)
 	tr.Del(trd)
@@ -178,16 +218,41 @@ func (server *Server) serveTCP(conn *net.TCPConn, rp, wp *bytes.Pool, tr *itime.
 	sion.Close()
 	// TODO Disconnect
 	if err = server.Disconect(id); err != nil {
-		log.Error("id: %s do disconnect error(%v)", id, err)
+		log.Error("id: %v do disconnect error(%v)", id, err)
 	}
 
 	return
 }
 
+// wrapTCP read the proxy header and do the tls handshake if opened, both
+// are bounded by the handshake timer. The client address in the header is
+// checked by the access control before the tls handshake.
+func (server *Server) wrapTCP(conn net.Conn, config *tls.Config) (net.Conn, error) {
+	// the client address is in the proxy header
+	if server.Options.ProxyTCP {
+		pc := proxyproto.NewConn(conn, server.Options.ProxyTrusted, 0)
+		if err := pc.Handshake(); err != nil {
+			return conn, err
+		}
+		if !server.allowed(pc.RemoteAddr()) {
+			return pc, ErrAccessDenied
+		}
+		conn = pc
+	}
+	if config != nil {
+		tc := tls.Server(conn, config)
+		if err := tc.Handshake(); err != nil {
+			return conn, err
+		}
+		conn = tc
+	}
+	return conn, nil
+}
+
 // dispatch accepts connections on the listener and serves requests
 // for each incoming connection.  dispatch blocks; the caller typically
 // invokes it in a go statement.
-func (server *Server) dispatchTCP(id uint64, conn *net.TCPConn, wr *bufio.Writer, wp *bytes.Pool, wb *bytes.Buffer, session *zone.Session) {
+func (server *Server) dispatchTCP(id uint64, conn net.Conn, wr *bufio.Writer, wp *bytes.Pool, wb *bytes.Buffer, session *zone.Session) {
 	var (
 		err    error
 		finish bool
@@ -195,9 +260,12 @@ func (server *Server) dispatchTCP(id uint64, conn *net.TCPConn, wr *bufio.Writer
 	
 	stat.RStat.IncWrite()
 	defer stat.RStat.DescWrite()
+	defer server.wg.Done()
 
 	for {
 		var p = session.Ready()
+		// deadline of the writes and flush of this round
+		server.writeDeadline(conn)
 		switch p {
 		case proto.ProtoFinish:
 			finish = true
@@ -209,6 +277,7 @@ func (server *Server) dispatchTCP(id uint64, conn *net.TCPConn, wr *bufio.Writer
 					err = nil // must be empty error
 					break
 				}
+				trace(session, "write", p)
 				if err = p.WriteTCP(wr); err != nil {
 					goto failed
 				}
@@ -217,6 +286,7 @@ func (server *Server) dispatchTCP(id uint64, conn *net.TCPConn, wr *bufio.Writer
 			}
 		default:
 			// server send
+			trace(session, "write", p)
 			if err = p.WriteTCP(wr); err != nil {
 				goto failed
 			}
@@ -230,6 +300,7 @@ func (server *Server) dispatchTCP(id uint64, conn *net.TCPConn, wr *bufio.Writer
 
 failed:
 	if err != nil {
+		writeError(err)
 		log.Error("id: %v dispatch tcp error(%v)", id, err)
 	}
 	conn.Close()
@@ -241,8 +312,9 @@ failed:
 	return
 }
 
-// auth for handshake with client, use rsa & aes.
-func (server *Server) authTCP(rr *bufio.Reader, wr *bufio.Writer, p *proto.Proto) (id uint64, zid int, heartbeat time.Duration, e error) {
+// auth for handshake with client, validated by the server authenticator.
+func (server *Server) authTCP(rr *bufio.Reader, wr *bufio.Writer, p *proto.Proto, sion *zone.Session, conn net.Conn) (ident Identity, e error) {
+	var err error
 	if e = p.ReadTCP(rr); e != nil {
 		return
 	}
@@ -252,27 +324,19 @@ func (server *Server) authTCP(rr *bufio.Reader, wr *bufio.Writer, p *proto.Proto
 		e = fmt.Errorf("invalid type %v", p.Type)
 		return
 	}
-	
-	auth := proto.Auth{}
-	if e = json.Unmarshal([]byte(p.Body), &auth); e != nil {
-		return
+
+	// reply before reject, client must know the reason code
+	ident, err = server.connect(p, sion, conn.RemoteAddr().String(), conn, nil)
+	if e = p.WriteTCP(wr); e == nil {
+		e = wr.Flush()
 	}
-	
-	log.Debug("uid = %v, code %v", auth.Uid, auth.Code)
-	// TODO auth from router, Return from router
-	NodeId := uint8(0)
-	ZondId := rand.Int() % math.MaxUint8
-	HeartBeat := 5
-	
-	//server.handle[p.Type](p)
-	if e = p.WriteTCP(wr); e != nil {
+	if e != nil {
+		// logged in, but the reply is lost
+		if err == nil {
+			server.Zone(sion.Id).Del(sion.Id)
+		}
 		return
 	}
-	
-	id = uint64(NodeId<<56) | uint64(ZondId<<48) | uint64(auth.Uid)
-	zid = int(ZondId)
-	heartbeat = time.Duration(HeartBeat)
-	
-	e = wr.Flush()
+	e = err
 	return
 }
@@ -2,51 +2,119 @@ package server
 
 import (
 	"crypto/tls"
+	"fmt"
 	"github.com/gorilla/websocket"
+	"im/comet/handle"
 	"im/comet/proto"
+	"im/comet/stat"
 	"im/comet/zone"
 	"im/pkg/log"
+	inet "im/pkg/net"
 	itime "im/pkg/time"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"strings"
 	"time"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  4096,
-	WriteBufferSize: 4096,
-	CheckOrigin: func(r *http.Request) bool {
+// WebsocketOptions configure the websocket upgrade.
+type WebsocketOptions struct {
+	Origins          []string // allowed origins, "*" wildcard, empty same host only
+	Compression      bool     // negotiate permessage-deflate
+	CompressionLevel int      // flate level of the compressed writes, 0 default
+	MaxFrameSize     int64    // max bytes of a read message, 0 unlimited
+	ReadBufferSize   int      // 0 default 4096
+	WriteBufferSize  int      // 0 default 4096
+
+	Poll        bool          // serve the long polling endpoints, see handlePoll
+	PollTimeout time.Duration // max hold of a poll request
+	SSE         bool          // serve the server-sent events endpoint /sse
+}
+
+// lowerOrigins lower the origin patterns for checkOrigin.
+func lowerOrigins(patterns []string) []string {
+	origins := make([]string, len(patterns))
+	for i, o := range patterns {
+		origins[i] = strings.ToLower(o)
+	}
+	return origins
+}
+
+func newUpgrader(options WebsocketOptions, origins []string) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    options.ReadBufferSize,
+		WriteBufferSize:   options.WriteBufferSize,
+		EnableCompression: options.Compression,
+		Subprotocols:      []string{proto.WebsocketBinary},
+		CheckOrigin: func(r *http.Request) bool {
+			if checkOrigin(r, origins) {
+				return true
+			}
+			log.Warn("websocket origin \"%s\" not allowed, reject %s", r.Header.Get("Origin"), r.RemoteAddr)
+			return false
+		},
+	}
+}
+
+// checkOrigin match the Origin header against the patterns, either the full
+// origin ("https://*.example.com") or the host ("*.example.com"). no patterns
+// allows the same host only, requests without Origin are not from browsers
+// and always allowed.
+func checkOrigin(r *http.Request, patterns []string) bool {
+	origin := strings.ToLower(r.Header.Get("Origin"))
+	if origin == "" {
 		return true
-	},
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if len(patterns) == 0 {
+		return u.Host == strings.ToLower(r.Host)
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, origin); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, u.Host); ok {
+			return true
+		}
+	}
+	return false
 }
 
 func InitWebsocket(addrs []string) (err error) {
 	var (
 		bind         string
-		listener     *net.TCPListener
-		addr         *net.TCPAddr
+		listener     net.Listener
 		httpServeMux = http.NewServeMux()
 		server       *http.Server
 	)
 	httpServeMux.HandleFunc("/sub", ServeWebSocket)
+	if DefaultServer.Options.Websocket.Poll {
+		DefaultServer.handlePoll(httpServeMux)
+	}
+	if DefaultServer.Options.Websocket.SSE {
+		httpServeMux.HandleFunc("/sse", DefaultServer.ServeSSE)
+	}
 
 	for _, bind = range addrs {
-		if addr, err = net.ResolveTCPAddr("tcp4", bind); err != nil {
-			log.Error("net.ResolveTCPAddr(\"tcp4\", \"%s\") error(%v)", bind, err)
-			return
-		}
-		if listener, err = net.ListenTCP("tcp4", addr); err != nil {
-			log.Error("net.ListenTCP(\"tcp4\", \"%s\") error(%v)", bind, err)
+		if listener, err = inet.Listen(bind); err != nil {
+			log.Error("inet.Listen(\"%s\") error(%v)", bind, err)
 			return
 		}
-		server = &http.Server{Handler: httpServeMux}
-		go func(host string) {
-			if err = server.Serve(listener); err != nil {
+		server = &http.Server{Handler: DefaultServer.accessHandler(httpServeMux)}
+		DefaultServer.addHTTPServer(server)
+		go func(host string, server *http.Server, listener net.Listener) {
+			listener = DefaultServer.accessListener(DefaultServer.proxyListener(listener))
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 				log.Error("server.Serve(\"%s\") error(%v)", host, err)
 				panic(err)
 			}
-		}(bind)
+		}(bind, server, listener)
 	}
 	return
 }
@@ -56,23 +124,31 @@ func InitWebsocketWithTLS(addrs []string, cert, priv string) (err error) {
 		httpServeMux = http.NewServeMux()
 	)
 	httpServeMux.HandleFunc("/sub", ServeWebSocket)
-	config := &tls.Config{}
-	config.Certificates = make([]tls.Certificate, 1)
-	if config.Certificates[0], err = tls.LoadX509KeyPair(cert, priv); err != nil {
+	if DefaultServer.Options.Websocket.Poll {
+		DefaultServer.handlePoll(httpServeMux)
+	}
+	if DefaultServer.Options.Websocket.SSE {
+		httpServeMux.HandleFunc("/sse", DefaultServer.ServeSSE)
+	}
+	var r *CertReloader
+	if r, err = NewCertReloader(cert, priv); err != nil {
 		return
 	}
+	DefaultServer.addCertReloader(r)
+	config := r.TLSConfig()
 	for _, bind := range addrs {
-		server := &http.Server{Addr: bind, Handler: httpServeMux}
+		var ln net.Listener
+		if ln, err = inet.Listen(bind); err != nil {
+			log.Error("inet.Listen(\"%s\") error(%v)", bind, err)
+			return
+		}
+		server := &http.Server{Addr: bind, Handler: DefaultServer.accessHandler(httpServeMux)}
 		server.SetKeepAlivesEnabled(true)
+		DefaultServer.addHTTPServer(server)
 		log.Debug("start websocket wss listen: \"%s\"", bind)
 		go func(host string) {
-			ln, err := net.Listen("tcp", host)
-			if err != nil {
-				return
-			}
-
-			tlsListener := tls.NewListener(ln, config)
-			if err = server.Serve(tlsListener); err != nil {
+			tlsListener := tls.NewListener(DefaultServer.accessListener(DefaultServer.proxyListener(ln)), config)
+			if err := server.Serve(tlsListener); err != nil && err != http.ErrServerClosed {
 				log.Error("server.Serve(\"%s\") error(%v)", host, err)
 				return
 			}
@@ -86,102 +162,133 @@ func ServeWebSocket(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "Method Not Allowed", 405)
 		return
 	}
-	ws, err := upgrader.Upgrade(w, req, nil)
+	if !DefaultServer.acquire() {
+		log.Warn("max conn reached, reject %s", req.RemoteAddr)
+		http.Error(w, "Service Unavailable", 503)
+		return
+	}
+	defer DefaultServer.release()
+	ws, err := DefaultServer.upgrader.Upgrade(w, req, nil)
 	if err != nil {
 		log.Error("Websocket Upgrade error(%v), userAgent(%s)", err, req.UserAgent())
 		return
 	}
 	defer ws.Close()
+	options := DefaultServer.Options.Websocket
+	if options.MaxFrameSize > 0 {
+		ws.SetReadLimit(options.MaxFrameSize)
+	}
+	if options.Compression && options.CompressionLevel != 0 {
+		ws.SetCompressionLevel(options.CompressionLevel)
+	}
 	var (
 		lAddr = ws.LocalAddr()
 		rAddr = ws.RemoteAddr()
 		tr    = DefaultServer.round.Timer(rand.Int())
 	)
-	log.Debug("start websocket serve \"%s\" with \"%s\"", lAddr, rAddr)
-	DefaultServer.serveWebsocket(ws, tr)
+	log.Debug("start websocket serve \"%s\" with \"%s\" subprotocol \"%s\"", lAddr, rAddr, ws.Subprotocol())
+	DefaultServer.serveWebsocket(newWsConn(ws), tr)
+}
+
+// wsConn is a websocket conn speaking json text frames, or binary frames in
+// the tcp wire format if the client negotiated proto.WebsocketBinary.
+type wsConn struct {
+	*websocket.Conn
+	binary bool
+}
+
+func newWsConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{Conn: ws, binary: ws.Subprotocol() == proto.WebsocketBinary}
+}
+
+func (c *wsConn) read(p *proto.Proto) error {
+	if c.binary {
+		return p.ReadWebsocketBinary(c.Conn)
+	}
+	return p.ReadWebsocket(c.Conn)
+}
+
+func (c *wsConn) write(p *proto.Proto) error {
+	if c.binary {
+		return p.WriteWebsocketBinary(c.Conn)
+	}
+	return p.WriteWebsocket(c.Conn)
 }
 
-func (server *Server) serveWebsocket(conn *websocket.Conn, tr *itime.Timer) {
+func (server *Server) serveWebsocket(conn *wsConn, tr *itime.Timer) {
 	var (
-		err  error
-		id   uint64
-		hb   time.Duration // heartbeat
-		p    *proto.Proto
-		z    *zone.Zone
-		trd  *itime.TimerData
-		sion = zone.NewSession(0, -1, server.Options.CliProto, server.Options.SvrProto)
+		err   error
+		id    uint64
+		ident Identity
+		p     *proto.Proto
+		z     *zone.Zone
+		trd   *itime.TimerData
+		ctx   *handle.Context
+		sion  = zone.NewSession(0, -1, server.Options.CliProto, server.Options.SvrProto)
 	)
 	// handshake
-	trd = tr.Add(server.Options.HandshakeTimeout, func() {
+	trd = tr.Add(server.HandshakeTimeout(), func() {
 		conn.Close()
 	})
+	// waited by Shutdown from now on
+	if !server.track() {
+		log.Warn("server closing, reject %s", conn.RemoteAddr())
+		conn.Close()
+		tr.Del(trd)
+		return
+	}
 	// must not setadv, only used in auth
 	if p, err = sion.CliProto.Set(); err == nil {
-		if id, sion.ZoneId, hb, err = server.authWebsocket(conn, p); err == nil {
+		if ident, err = server.authWebsocket(conn, p, sion); err == nil {
+			id = sion.Id
 			z = server.Zone(id)
-			z.Put(sion)
 		}
 	}
 	if err != nil {
 		conn.Close()
 		tr.Del(trd)
-		log.Error("handshake failed error(%v)", err)
+		server.wg.Done()
+		log.Error("key: %v websocket handshake failed error(%v)", id, err)
 		return
 	}
 	trd.Key = id
-	tr.Set(trd, hb)
-	// hanshake ok start dispatch goroutine
+	tr.Set(trd, ident.Heartbeat)
+	// handshake ok start dispatch goroutine
 	go server.dispatchWebsocket(id, conn, sion)
-	for {
-		if p, err = sion.CliProto.Set(); err != nil {
-			break
-		}
-		if err = p.ReadWebsocket(conn); err != nil {
-			break
-		}
-		//p.Time = *globalNowTime
-		//if p.Type == proto.OP_HEARTBEAT {
-		//	// heartbeat
-		//	tr.Set(trd, hb)
-		//	p.Body = nil
-		//	p.Type = proto.OP_HEARTBEAT_REPLY
-		//} else {
-		//	// process message
-		//	if err = server.operator.Operate(p); err != nil {
-		//		break
-		//	}
-		//}
-		sion.CliProto.SetAdv()
-		sion.Signal()
-	}
+	ctx = handle.NewContext(server, sion)
+	stat.RStat.IncRead()
+	defer stat.RStat.DescRead()
+	err = server.serveRead(ctx, conn.read, tr, trd, ident.Heartbeat, "websocket")
 
+	z.Del(id)
 	tr.Del(trd)
 	conn.Close()
 	sion.Close()
-	z.Del(id)
-	// TODO disconnect
-	//if err = server.operator.Disconnect(key, sion.ZoneId); err != nil {
-	//	log.Error("key: %s operator do disconnect error(%v)", key, err)
-	//}
-
+	if err = server.Disconect(id); err != nil {
+		log.Error("id: %v do disconnect error(%v)", id, err)
+	}
 	return
 }
 
 // dispatch accepts connections on the listener and serves requests
 // for each incoming connection.  dispatch blocks; the caller typically
 // invokes it in a go statement.
-func (server *Server) dispatchWebsocket(id uint64, conn *websocket.Conn, sion *zone.Session) {
+func (server *Server) dispatchWebsocket(id uint64, conn *wsConn, sion *zone.Session) {
 	var (
 		p   *proto.Proto
 		err error
 	)
 
-	log.Debug("key: %s start dispatch websocket goroutine", id)
+	stat.RStat.IncWrite()
+	defer stat.RStat.DescWrite()
+	defer server.wg.Done()
+	log.Debug("key: %v start dispatch websocket goroutine", id)
 	for {
 		p = sion.Ready()
+		server.writeDeadline(conn)
 		switch p {
 		case proto.ProtoFinish:
-			log.Debug("key: %s wakeup exit dispatch goroutine", id)
+			log.Debug("key: %v wakeup exit dispatch goroutine", id)
 			goto failed
 		case proto.ProtoReady:
 			for {
@@ -189,23 +296,25 @@ func (server *Server) dispatchWebsocket(id uint64, conn *websocket.Conn, sion *z
 					err = nil // must be empty error
 					break
 				}
-				if err = p.WriteWebsocket(conn); err != nil {
+				trace(sion, "write", p)
+				if err = conn.write(p); err != nil {
 					goto failed
 				}
 				p.Body = nil // avoid memory leak
 				sion.CliProto.GetAdv()
 			}
 		default:
-			// TODO room-push support
 			// just forward the message
-			if err = p.WriteWebsocket(conn); err != nil {
+			trace(sion, "write", p)
+			if err = conn.write(p); err != nil {
 				goto failed
 			}
 		}
 	}
 failed:
 	if err != nil {
-		log.Error("key: %s dispatch websocket error(%v)", id, err)
+		writeError(err)
+		log.Error("key: %v dispatch websocket error(%v)", id, err)
 	}
 	conn.Close()
 	// must ensure all channel message discard, for reader won't blocking Signal
@@ -219,19 +328,27 @@ failed:
 	return
 }
 
-func (server *Server) authWebsocket(conn *websocket.Conn, p *proto.Proto) (id uint64, zid int, heartbeat time.Duration, err error) {
-	if err = p.ReadWebsocket(conn); err != nil {
+// auth for handshake with client, validated by the server authenticator.
+func (server *Server) authWebsocket(conn *wsConn, p *proto.Proto, sion *zone.Session) (ident Identity, e error) {
+	var err error
+	if e = conn.read(p); e != nil {
+		return
+	}
+	if p.Type != proto.C2S_AUTH {
+		log.Warn("auth operation not valid: %d", p.Type)
+		e = fmt.Errorf("invalid type %v", p.Type)
+		return
+	}
+
+	// reply before reject, client must know the reason code
+	ident, err = server.connect(p, sion, conn.RemoteAddr().String(), conn, nil)
+	if e = conn.write(p); e != nil {
+		// logged in, but the reply is lost
+		if err == nil {
+			server.Zone(sion.Id).Del(sion.Id)
+		}
 		return
 	}
-	//if p.Type != proto.OP_AUTH {
-	//	err = ErrOperation
-	//	return
-	//}
-	//if key, rid, heartbeat, err = server.operator.Connect(p); err != nil {
-	//	return
-	//}
-	//p.Body = emptyJSONBody
-	//p.Type = proto.OP_AUTH_REPLY
-	err = p.WriteWebsocket(conn)
+	e = err
 	return
 }
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	cases := []struct {
+		origin   string
+		patterns []string
+		ok       bool
+	}{
+		{"", []string{"https://a.com"}, true},
+		{"https://comet.io", nil, true},
+		{"https://evil.com", nil, false},
+		{"https://a.com", []string{"https://a.com"}, true},
+		{"http://a.com", []string{"https://a.com"}, false},
+		{"https://x.a.com", []string{"https://*.a.com"}, true},
+		{"http://x.a.com", []string{"*.a.com"}, true},
+		{"https://a.com.evil.com", []string{"*.a.com"}, false},
+		{"https://evil.com", []string{"*"}, true},
+	}
+	for _, c := range cases {
+		r := &http.Request{Host: "comet.io", Header: http.Header{}}
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if ok := checkOrigin(r, c.patterns); ok != c.ok {
+			t.Errorf("origin \"%s\" patterns %v got %v", c.origin, c.patterns, ok)
+		}
+	}
+}
@@ -1,37 +1,186 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"im/comet/proto"
+	"im/comet/zone"
 	"log"
+	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+var (
+	ErrWhitelistKey = errors.New("whitelist key must not be empty or a bare \"*\"")
+)
+
+// Whitelist trace every proto of the listed sessions to Log, for debugging
+// one user in production. A session key is "uid_id", an entry is a uid, a
+// whole key or a key prefix ending with "*".
 type Whitelist struct {
 	Log  *log.Logger
+	lock sync.RWMutex
 	list map[string]struct{} // whitelist for debug
+	size int32               // len(list), read without lock
 }
 
 // NewWhitelist a whitelist struct.
 func NewWhitelist(file string, list []string) (w *Whitelist, err error) {
-	var (
-		key string
-		f   *os.File
-	)
+	var f *os.File
 	if f, err = os.OpenFile(file, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644); err == nil {
 		w = new(Whitelist)
 		w.Log = log.New(f, "", log.LstdFlags)
-		w.list = make(map[string]struct{})
-		for _, key = range list {
-			w.list[key] = struct{}{}
-		}
+		w.Set(list)
 	}
 	return
 }
 
 // Contains whitelist contains a key or not.
 func (w *Whitelist) Contains(key string) (ok bool) {
+	if atomic.LoadInt32(&w.size) == 0 {
+		return
+	}
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if _, ok = w.list[key]; ok {
+		return
+	}
 	if ix := strings.Index(key, "_"); ix > -1 {
-		_, ok = w.list[key[:ix]]
+		if _, ok = w.list[key[:ix]]; ok {
+			return
+		}
+	}
+	for k := range w.list {
+		if strings.HasSuffix(k, "*") && strings.HasPrefix(key, k[:len(k)-1]) {
+			return true
+		}
+	}
+	return
+}
+
+// ValidWhitelistKey check key, a key matching every session is not valid.
+func ValidWhitelistKey(key string) error {
+	if key == "" || key == "*" {
+		return ErrWhitelistKey
+	}
+	return nil
+}
+
+// Set replace the list, the keys not valid are skipped.
+func (w *Whitelist) Set(list []string) {
+	m := make(map[string]struct{}, len(list))
+	for _, key := range list {
+		if ValidWhitelistKey(key) == nil {
+			m[key] = struct{}{}
+		}
 	}
+	w.lock.Lock()
+	w.list = m
+	atomic.StoreInt32(&w.size, int32(len(m)))
+	w.lock.Unlock()
+}
+
+// Add add keys to the list, nothing is added if any key is not valid.
+func (w *Whitelist) Add(keys ...string) (err error) {
+	for _, key := range keys {
+		if err = ValidWhitelistKey(key); err != nil {
+			return
+		}
+	}
+	w.lock.Lock()
+	for _, key := range keys {
+		w.list[key] = struct{}{}
+	}
+	atomic.StoreInt32(&w.size, int32(len(w.list)))
+	w.lock.Unlock()
 	return
 }
+
+// Del remove keys from the list.
+func (w *Whitelist) Del(keys ...string) {
+	w.lock.Lock()
+	for _, key := range keys {
+		delete(w.list, key)
+	}
+	atomic.StoreInt32(&w.size, int32(len(w.list)))
+	w.lock.Unlock()
+}
+
+// List get the sorted list.
+func (w *Whitelist) List() (keys []string) {
+	w.lock.RLock()
+	keys = make([]string, 0, len(w.list))
+	for key := range w.list {
+		keys = append(keys, key)
+	}
+	w.lock.RUnlock()
+	sort.Strings(keys)
+	return
+}
+
+// Handler get the admin handler editing the list at runtime, requests must
+// carry the secret as "Authorization: Bearer <secret>". Every method replies
+// the list:
+//
+//	GET                  the list
+//	POST   ?key=&key=    add keys
+//	DELETE ?key=&key=    remove keys
+func (w *Whitelist) Handler(secret string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !bearerAuth(r, []byte(secret)) {
+			http.Error(rw, "Unauthorized", 401)
+			return
+		}
+		w.serveHTTP(rw, r)
+	})
+}
+
+func (w *Whitelist) serveHTTP(rw http.ResponseWriter, r *http.Request) {
+	keys := r.URL.Query()["key"]
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if err := w.Add(keys...); err != nil {
+			http.Error(rw, err.Error(), 400)
+			return
+		}
+	case "DELETE":
+		w.Del(keys...)
+	default:
+		http.Error(rw, "Method Not Allowed", 405)
+		return
+	}
+	b, _ := json.Marshal(w.List())
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(b)
+}
+
+// sessionKey the whitelist key of a session.
+func sessionKey(sion *zone.Session) string {
+	return fmt.Sprintf("%d_%d", sion.Uid, sion.Id)
+}
+
+// trace log p if the session is whitelisted, action is what is done to p,
+// a raw proto is logged proto by proto.
+func trace(sion *zone.Session, action string, p *proto.Proto) {
+	w := DefaultWhitelist
+	if w == nil || atomic.LoadInt32(&w.size) == 0 {
+		return
+	}
+	key := sessionKey(sion)
+	if !w.Contains(key) {
+		return
+	}
+	if p.Type != proto.PROTO_RAW {
+		w.Log.Printf("key: %s %s proto: ver %d type %d seq %d body %s\n", key, action, p.Ver, p.Type, p.SeqId, p.Body)
+		return
+	}
+	for _, ph := range p.RawProtos() {
+		w.Log.Printf("key: %s %s raw proto: ver %d type %d seq %d body %s\n", key, action, ph.Ver, ph.Type, ph.SeqId, ph.Body)
+	}
+}
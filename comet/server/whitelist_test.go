@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestWhitelist(t *testing.T) {
+	w, err := NewWhitelist(filepath.Join(t.TempDir(), "white.log"), []string{"1001", "1002_42", "7*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		key string
+		ok  bool
+	}{
+		{"1001_5", true},
+		{"1002_42", true},
+		{"1002_43", false},
+		{"700_1", true},
+		{"1003_1", false},
+	}
+	for _, c := range cases {
+		if ok := w.Contains(c.key); ok != c.ok {
+			t.Errorf("key %s got %v", c.key, ok)
+		}
+	}
+	w.Add("1003")
+	w.Del("1001", "7*")
+	if !w.Contains("1003_1") || w.Contains("1001_5") || w.Contains("700_1") {
+		t.Errorf("edited list %v", w.List())
+	}
+	w.Set(nil)
+	if w.Contains("1003_1") {
+		t.Errorf("empty list contains 1003_1")
+	}
+}
+
+func TestWhitelistHandler(t *testing.T) {
+	w, err := NewWhitelist(filepath.Join(t.TempDir(), "white.log"), []string{"1001", "*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Contains("1002_1") {
+		t.Fatal("bare * from the config kept")
+	}
+	ts := httptest.NewServer(w.Handler("k"))
+	defer ts.Close()
+	do := func(method, query, auth string) (code int, list []string) {
+		req, _ := http.NewRequest(method, ts.URL+"/admin/whitelist"+query, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(&list)
+		return resp.StatusCode, list
+	}
+	if code, _ := do("POST", "?key=1002", ""); code != 401 {
+		t.Errorf("no auth %d", code)
+	}
+	if code, _ := do("POST", "?key=1002", "Bearer x"); code != 401 || w.Contains("1002_1") {
+		t.Errorf("bad auth %d", code)
+	}
+	if code, _ := do("POST", "?key=1003&key=*", "Bearer k"); code != 400 || w.Contains("1003_1") {
+		t.Errorf("bare * %d", code)
+	}
+	if code, list := do("POST", "?key=1002", "Bearer k"); code != 200 || len(list) != 2 || !w.Contains("1002_1") {
+		t.Errorf("add %d %v", code, list)
+	}
+	if code, list := do("DELETE", "?key=1001", "Bearer k"); code != 200 || len(list) != 1 || list[0] != "1002" {
+		t.Errorf("del %d %v", code, list)
+	}
+	if code, list := do("GET", "", "Bearer k"); code != 200 || len(list) != 1 {
+		t.Errorf("get %d %v", code, list)
+	}
+	if code, _ := do("PUT", "", "Bearer k"); code != 405 {
+		t.Errorf("put %d", code)
+	}
+	// no secret, no access
+	ts2 := httptest.NewServer(w.Handler(""))
+	defer ts2.Close()
+	req, _ := http.NewRequest("GET", ts2.URL, nil)
+	req.Header.Set("Authorization", "Bearer ")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != 401 {
+		t.Errorf("empty secret %v error(%v)", resp, err)
+	}
+}
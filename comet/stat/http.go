@@ -0,0 +1,96 @@
+package stat
+
+import (
+	"encoding/json"
+	"im/pkg/log"
+	inet "im/pkg/net"
+	"net"
+	"net/http"
+	"sync"
+)
+
+var (
+	statLock     sync.Mutex
+	statServers  = map[string]*http.Server{}
+	statHandlers = map[string]http.Handler{} // registered by Handle
+)
+
+// Handle register an admin handler on the stat binds, it must be called
+// before StartStats.
+func Handle(pattern string, handler http.Handler) {
+	statLock.Lock()
+	statHandlers[pattern] = handler
+	statLock.Unlock()
+}
+
+// statListen start a stat http server on bind.
+func statListen(bind string) {
+	statLock.Lock()
+	listen(bind)
+	statLock.Unlock()
+}
+
+// listen must be called with statLock held.
+func listen(bind string) {
+	var (
+		l   net.Listener
+		err error
+		mux = http.NewServeMux()
+	)
+	mux.HandleFunc("/stat/msg", func(w http.ResponseWriter, r *http.Request) { w.Write(MsgStat.Stat()) })
+	mux.HandleFunc("/stat/routine", func(w http.ResponseWriter, r *http.Request) { w.Write(RStat.Stat()) })
+	mux.HandleFunc("/stat/handle", func(w http.ResponseWriter, r *http.Request) { w.Write(HStat.Stat()) })
+	mux.HandleFunc("/stat/slow", func(w http.ResponseWriter, r *http.Request) { w.Write(SlowStat.Stat()) })
+	mux.HandleFunc("/stat/zones", func(w http.ResponseWriter, r *http.Request) { w.Write(SvrZones.Stat()) })
+	mux.HandleFunc("/stat/access", func(w http.ResponseWriter, r *http.Request) { w.Write(AccessStat.Stat()) })
+	mux.HandleFunc("/stat/conn", func(w http.ResponseWriter, r *http.Request) { w.Write(SvrZones.Connection()) })
+	for pattern, handler := range statHandlers {
+		mux.Handle(pattern, handler)
+	}
+	if l, err = inet.Listen(bind); err != nil {
+		log.Error("inet.Listen(\"%s\") error(%v)", bind, err)
+		return
+	}
+	server := &http.Server{Handler: mux}
+	statServers[bind] = server
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Error("stat server.Serve(\"%s\") error(%v)", bind, err)
+		}
+	}()
+}
+
+// ReloadStats listen the new stat binds and close the removed ones.
+func ReloadStats(bind []string) {
+	var (
+		addr string
+		keep = map[string]bool{}
+	)
+	for _, addr = range bind {
+		keep[addr] = true
+	}
+	statLock.Lock()
+	for addr, server := range statServers {
+		if !keep[addr] {
+			server.Close()
+			delete(statServers, addr)
+			log.Info("stop stat listen addr:\"%s\"", addr)
+		}
+	}
+	for _, addr = range bind {
+		if _, ok := statServers[addr]; !ok {
+			log.Info("start stat listen addr:\"%s\"", addr)
+			listen(addr)
+		}
+	}
+	statLock.Unlock()
+}
+
+func jsonRes(res interface{}) []byte {
+	b, err := json.Marshal(res)
+	if err != nil {
+		log.Error("json.Marshal(%v) error(%v)", res, err)
+		return []byte("{}")
+	}
+	return b
+}
@@ -2,6 +2,8 @@ package stat
 
 import (
 	"im/pkg/log"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -10,9 +12,12 @@ var (
 	// server
 	startTime int64 // process start unixnano
 	// message
-	MsgStat = &MessageStat{}
-	RStat   = &RoutineStat{}
-	SvrZones *ZonesStat
+	MsgStat    = &MessageStat{}
+	RStat      = &RoutineStat{}
+	HStat      = NewHandleStat()
+	SlowStat   = &SlowClientStat{}
+	AccessStat = &AccessControlStat{}
+	SvrZones   *ZonesStat
 )
 
 // Message stat info
@@ -67,6 +72,118 @@ func (rs *RoutineStat) Stat() []byte {
 	return jsonRes(res)
 }
 
+// slow client stat info
+type SlowClientStat struct {
+	DropNewest   uint64 // pushed message dropped by a full session
+	DropOldest   uint64 // queued message dropped by a full session
+	Evicted      uint64 // full session disconnected
+	WriteTimeout uint64 // session disconnected by write timeout
+}
+
+func (s *SlowClientStat) IncrDropNewest() {
+	atomic.AddUint64(&s.DropNewest, 1)
+}
+
+func (s *SlowClientStat) IncrDropOldest() {
+	atomic.AddUint64(&s.DropOldest, 1)
+}
+
+func (s *SlowClientStat) IncrEvicted() {
+	atomic.AddUint64(&s.Evicted, 1)
+}
+
+func (s *SlowClientStat) IncrWriteTimeout() {
+	atomic.AddUint64(&s.WriteTimeout, 1)
+}
+
+func (s *SlowClientStat) Stat() []byte {
+	res := make(map[string]interface{})
+	res["drop_newest"] = atomic.LoadUint64(&s.DropNewest)
+	res["drop_oldest"] = atomic.LoadUint64(&s.DropOldest)
+	res["evicted"] = atomic.LoadUint64(&s.Evicted)
+	res["write_timeout"] = atomic.LoadUint64(&s.WriteTimeout)
+	return jsonRes(res)
+}
+
+// access control stat info
+type AccessControlStat struct {
+	Denied     uint64 // conn rejected by a deny cidr
+	NotAllowed uint64 // conn rejected by no allow cidr
+}
+
+func (s *AccessControlStat) IncrDenied() {
+	atomic.AddUint64(&s.Denied, 1)
+}
+
+func (s *AccessControlStat) IncrNotAllowed() {
+	atomic.AddUint64(&s.NotAllowed, 1)
+}
+
+func (s *AccessControlStat) Stat() []byte {
+	res := make(map[string]interface{})
+	res["denied"] = atomic.LoadUint64(&s.Denied)
+	res["not_allowed"] = atomic.LoadUint64(&s.NotAllowed)
+	return jsonRes(res)
+}
+
+// handle stat info of one message type
+type HandleInfo struct {
+	Count  uint64 // total handled count
+	Failed uint64 // error reply or handle error count
+	Cost   int64  // total nanoseconds cost
+}
+
+type HandleStat struct {
+	lock  sync.RWMutex
+	types map[int16]*HandleInfo
+}
+
+func NewHandleStat() *HandleStat {
+	return &HandleStat{types: make(map[int16]*HandleInfo)}
+}
+
+func (hs *HandleStat) info(typ int16) *HandleInfo {
+	hs.lock.RLock()
+	info, ok := hs.types[typ]
+	hs.lock.RUnlock()
+	if !ok {
+		hs.lock.Lock()
+		if info, ok = hs.types[typ]; !ok {
+			info = new(HandleInfo)
+			hs.types[typ] = info
+		}
+		hs.lock.Unlock()
+	}
+	return info
+}
+
+// Incr count one handle of message type typ.
+func (hs *HandleStat) Incr(typ int16, cost time.Duration, failed bool) {
+	info := hs.info(typ)
+	atomic.AddUint64(&info.Count, 1)
+	atomic.AddInt64(&info.Cost, int64(cost))
+	if failed {
+		atomic.AddUint64(&info.Failed, 1)
+	}
+}
+
+func (hs *HandleStat) Stat() []byte {
+	res := make(map[string]interface{})
+	hs.lock.RLock()
+	for typ, info := range hs.types {
+		st := make(map[string]interface{})
+		count := atomic.LoadUint64(&info.Count)
+		st["count"] = count
+		st["failed"] = atomic.LoadUint64(&info.Failed)
+		if count > 0 {
+			st["avg_cost_us"] = atomic.LoadInt64(&info.Cost) / int64(count) / int64(time.Microsecond)
+		}
+		res[strconv.Itoa(int(typ))] = st
+	}
+	hs.lock.RUnlock()
+	return jsonRes(res)
+}
+
 // zone stat info
 type ZoneInfo struct {
 	Add    uint64
@@ -86,7 +203,11 @@ type ZonesStat struct {
 }
 
 func NewZonesStat(zsize int) *ZonesStat {
-	return &ZonesStat{Zones: make([]*ZoneInfo, zsize, zsize)}
+	sz := &ZonesStat{Zones: make([]*ZoneInfo, zsize, zsize)}
+	for i := range sz.Zones {
+		sz.Zones[i] = new(ZoneInfo)
+	}
+	return sz
 }
 
 func (sz *ZonesStat) IncrAdd(id int) {
@@ -98,7 +219,7 @@ func (sz *ZonesStat) IncrRemove(id int) {
 }
 
 func (sz *ZonesStat) Stat() []byte {
-	res := make([]interface{}, len(sz.Zones))
+	res := make([]interface{}, 0, len(sz.Zones))
 	for idx, zone := range sz.Zones {
 		st := make(map[string]interface{})
 		st["id"] = idx
@@ -127,7 +248,7 @@ func StartStats(bind []string, zsize int) {
 	SvrZones = NewZonesStat(zsize)
 	for _, bind := range bind {
 		log.Info("start stat listen addr:\"%s\"", bind)
-		go statListen(bind)
+		statListen(bind)
 	}
 }
 
@@ -64,3 +64,27 @@ func (r *Round) Reader(rn int) *bytes.Pool {
 func (r *Round) Writer(rn int) *bytes.Pool {
 	return &(r.writers[rn%r.options.WriterNum])
 }
+
+// Slice get the i-th of n rounds sharing disjoint parts of the readers,
+// writers and timers, so n accept loops don't contend on the same ones. a
+// part has one element if there are less than n.
+func (r *Round) Slice(i, n int) (s *Round) {
+	var lo, hi int
+	s = new(Round)
+	s.options = r.options
+	lo, hi = span(i, n, r.options.ReaderNum)
+	s.readers, s.options.ReaderNum = r.readers[lo:hi], hi-lo
+	lo, hi = span(i, n, r.options.WriterNum)
+	s.writers, s.options.WriterNum = r.writers[lo:hi], hi-lo
+	lo, hi = span(i, n, r.options.TimerNum)
+	s.timers, s.options.TimerNum = r.timers[lo:hi], hi-lo
+	return
+}
+
+func span(i, n, num int) (lo, hi int) {
+	if num < n {
+		lo = i % num
+		return lo, lo + 1
+	}
+	return i * num / n, (i + 1) * num / n
+}
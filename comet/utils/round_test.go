@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestRoundSlice(t *testing.T) {
+	r := NewRound(RoundOptions{
+		TimerNum: 2, TimerSize: 1,
+		ReaderNum: 8, ReadbufNum: 1, ReadbufSize: 1,
+		WriterNum: 8, WritebufNum: 1, WritebufSize: 1,
+	})
+	seen := map[interface{}]int{}
+	for i := 0; i < 4; i++ {
+		s := r.Slice(i, 4)
+		if s.options.ReaderNum != 2 || s.options.TimerNum != 1 {
+			t.Fatalf("slice %d options %+v", i, s.options)
+		}
+		for rn := 0; rn < 2; rn++ {
+			seen[s.Reader(rn)]++
+		}
+	}
+	// every reader in exactly one slice
+	if len(seen) != 8 {
+		t.Errorf("readers %d, want 8", len(seen))
+	}
+	for p, n := range seen {
+		if n != 1 {
+			t.Errorf("reader %p in %d slices", p, n)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package zone
+
+// Session id layout, seq is a per-node sequence so one uid connected many
+// times (multi-device) still gets distinct ids:
+//
+//	|--node--|--zone--|--seq--|--uid--|
+//	     8        8       16      32
+const (
+	NodeBits = 8
+	ZoneBits = 8
+	SeqBits  = 16
+	UidBits  = 32
+
+	UidShift  = 0
+	SeqShift  = UidShift + UidBits
+	ZoneShift = SeqShift + SeqBits
+	NodeShift = ZoneShift + ZoneBits
+
+	MaxNode = 1 << NodeBits
+	MaxZone = 1 << ZoneBits
+)
+
+// EncodeId build a session id.
+func EncodeId(node, zone int, seq uint16, uid uint32) uint64 {
+	return uint64(uint8(node))<<NodeShift | uint64(uint8(zone))<<ZoneShift | uint64(seq)<<SeqShift | uint64(uid)<<UidShift
+}
+
+// DecodeId split a session id.
+func DecodeId(id uint64) (node, zone int, seq uint16, uid uint32) {
+	return NodeOf(id), ZoneOf(id), SeqOf(id), UidOf(id)
+}
+
+// NodeOf get the comet node of the session id.
+func NodeOf(id uint64) int {
+	return int(uint8(id >> NodeShift))
+}
+
+// ZoneOf get the zone index of the session id.
+func ZoneOf(id uint64) int {
+	return int(uint8(id >> ZoneShift))
+}
+
+// SeqOf get the node sequence of the session id.
+func SeqOf(id uint64) uint16 {
+	return uint16(id >> SeqShift)
+}
+
+// UidOf get the user id of the session id.
+func UidOf(id uint64) uint32 {
+	return uint32(id >> UidShift)
+}
@@ -0,0 +1,19 @@
+package zone
+
+import (
+	"testing"
+)
+
+func TestId(t *testing.T) {
+	id := EncodeId(3, 255, 65535, 1<<32-1)
+	node, zone, seq, uid := DecodeId(id)
+	if node != 3 || zone != 255 || seq != 65535 || uid != 1<<32-1 {
+		t.Fatalf("decode %d: %d %d %d %d", id, node, zone, seq, uid)
+	}
+	if EncodeId(1, 2, 3, 4) == EncodeId(1, 2, 4, 4) {
+		t.FailNow()
+	}
+	if id = EncodeId(0, 1, 0, 0); id != 1<<ZoneShift {
+		t.Fatalf("zone id %d", id)
+	}
+}
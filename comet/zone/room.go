@@ -0,0 +1,164 @@
+package zone
+
+import (
+	"errors"
+	"hash/fnv"
+	"im/comet/proto"
+	"sync"
+)
+
+const (
+	MaxRoomIdLen   = 64
+	MaxSessionRoom = 32 // rooms a session can be in at once
+)
+
+var (
+	ErrRoomNotFound  = errors.New("room not found")
+	ErrRoomId        = errors.New("room id not valid")
+	ErrRoomLimit     = errors.New("session room limit reached")
+	ErrSessionClosed = errors.New("session closed")
+)
+
+// Room is a set of sessions receiving the same pushes, e.g. a chat room or a
+// live stream audience.
+type Room struct {
+	Id       string
+	rLock    sync.RWMutex
+	sessions map[uint64]*Session
+}
+
+// Push push p to every member, p is encoded once as a raw proto. Returns the
+// number of members queued it.
+func (r *Room) Push(p *proto.Proto) (n int) {
+	if p.Type != proto.PROTO_RAW {
+		p = proto.NewRaw(p)
+	}
+	r.rLock.RLock()
+	for _, session := range r.sessions {
+		if session.Push(p) == nil {
+			n++
+		}
+	}
+	r.rLock.RUnlock()
+	return
+}
+
+// Online get the number of members.
+func (r *Room) Online() (n int) {
+	r.rLock.RLock()
+	n = len(r.sessions)
+	r.rLock.RUnlock()
+	return
+}
+
+// Rooms is a shard of the room registry, a room is in the shard RoomIndex
+// chooses and removed once empty.
+type Rooms struct {
+	rLock sync.RWMutex
+	rooms map[string]*Room
+}
+
+// NewRooms new a room shard.
+func NewRooms() *Rooms {
+	return &Rooms{rooms: make(map[string]*Room)}
+}
+
+// RoomIndex get the shard of room id in n shards.
+func RoomIndex(id string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(n))
+}
+
+// Room get the room id, nil if nobody is in.
+func (b *Rooms) Room(id string) (room *Room) {
+	b.rLock.RLock()
+	room = b.rooms[id]
+	b.rLock.RUnlock()
+	return
+}
+
+// Join put the session into room id, the room is created if not exists.
+// Returns the members online.
+func (b *Rooms) Join(id string, session *Session) (online int, e error) {
+	if id == "" || len(id) > MaxRoomIdLen {
+		return 0, ErrRoomId
+	}
+	// under the session lock, a session removed from its zone never joins
+	session.roomLock.Lock()
+	defer session.roomLock.Unlock()
+	if session.roomClosed {
+		return 0, ErrSessionClosed
+	}
+	if _, ok := session.rooms[id]; !ok && len(session.rooms) >= MaxSessionRoom {
+		return 0, ErrRoomLimit
+	}
+	b.rLock.Lock()
+	room, ok := b.rooms[id]
+	if !ok {
+		room = &Room{Id: id, sessions: make(map[uint64]*Session)}
+		b.rooms[id] = room
+	}
+	room.rLock.Lock()
+	room.sessions[session.Id] = session
+	online = len(room.sessions)
+	room.rLock.Unlock()
+	b.rLock.Unlock()
+	if session.rooms == nil {
+		session.rooms = make(map[string]*Rooms)
+	}
+	session.rooms[id] = b
+	return
+}
+
+// Leave remove the session from room id.
+func (b *Rooms) Leave(id string, session *Session) (e error) {
+	session.roomLock.Lock()
+	if _, ok := session.rooms[id]; !ok {
+		e = ErrRoomNotFound
+	} else {
+		delete(session.rooms, id)
+	}
+	session.roomLock.Unlock()
+	if e == nil {
+		b.leave(id, session)
+	}
+	return
+}
+
+// leave remove the session from the room, the room is removed once empty.
+func (b *Rooms) leave(id string, session *Session) {
+	b.rLock.Lock()
+	if room, ok := b.rooms[id]; ok {
+		room.rLock.Lock()
+		delete(room.sessions, session.Id)
+		if len(room.sessions) == 0 {
+			delete(b.rooms, id)
+		}
+		room.rLock.Unlock()
+	}
+	b.rLock.Unlock()
+}
+
+// Rooms get the room ids the session is in.
+func (c *Session) Rooms() (ids []string) {
+	c.roomLock.Lock()
+	for id := range c.rooms {
+		ids = append(ids, id)
+	}
+	c.roomLock.Unlock()
+	return
+}
+
+// LeaveRooms remove the session from all its rooms, it can't join any more.
+// Called when the session is removed from its zone.
+func (c *Session) LeaveRooms() {
+	c.roomLock.Lock()
+	rooms := c.rooms
+	c.rooms = nil
+	c.roomClosed = true
+	c.roomLock.Unlock()
+	for id, b := range rooms {
+		b.leave(id, c)
+	}
+}
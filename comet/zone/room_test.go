@@ -0,0 +1,58 @@
+package zone
+
+import (
+	"fmt"
+	"im/comet/proto"
+	"im/comet/stat"
+	"testing"
+)
+
+func TestRooms(t *testing.T) {
+	stat.SvrZones = stat.NewZonesStat(1)
+	z := NewZone(0, ZoneOptions{CacheSize: 4})
+	b := NewRooms()
+	s1 := NewSession(1, 0, 1, 2)
+	s2 := NewSession(2, 0, 1, 2)
+	z.Put(s1, DupLoginAllow)
+	z.Put(s2, DupLoginAllow)
+	if _, e := b.Join("", s1); e != ErrRoomId {
+		t.Fatalf("empty room id error(%v)", e)
+	}
+	b.Join("live", s1)
+	if online, e := b.Join("live", s2); e != nil || online != 2 {
+		t.Fatalf("join online %d error(%v)", online, e)
+	}
+	if n := b.Room("live").Push(&proto.Proto{Type: proto.S2C_CALCULATE, Body: []byte("{}")}); n != 2 {
+		t.Fatalf("push delivered %d", n)
+	}
+	if p := s2.Ready(); p.Type != proto.PROTO_RAW || len(p.RawProtos()) != 1 {
+		t.Fatalf("pushed %v", p)
+	}
+
+	// removed from the zone, removed from the rooms and can't join again
+	z.Del(2)
+	if online := b.Room("live").Online(); online != 1 {
+		t.Fatalf("online %d after del", online)
+	}
+	if _, e := b.Join("live", s2); e != ErrSessionClosed {
+		t.Fatalf("join after del error(%v)", e)
+	}
+	if e := b.Leave("live", s1); e != nil || b.Room("live") != nil {
+		t.Fatalf("empty room kept error(%v)", e)
+	}
+	if e := b.Leave("live", s1); e != ErrRoomNotFound {
+		t.Fatalf("leave twice error(%v)", e)
+	}
+
+	for i := 0; i < MaxSessionRoom; i++ {
+		if _, e := b.Join(fmt.Sprint(i), s1); e != nil {
+			t.Fatalf("join %d error(%v)", i, e)
+		}
+	}
+	if _, e := b.Join("more", s1); e != ErrRoomLimit {
+		t.Fatalf("room limit error(%v)", e)
+	}
+	if len(s1.Rooms()) != MaxSessionRoom {
+		t.Fatalf("rooms %v", s1.Rooms())
+	}
+}
@@ -2,14 +2,45 @@ package zone
 
 import (
 	"errors"
+	"fmt"
 	"im/comet/proto"
+	"im/comet/stat"
 	"im/comet/utils"
 	"im/pkg/bufio"
 	"im/pkg/log"
+	"io"
+	"sync"
+	"time"
 )
 
+// overflow policy of a full session
+const (
+	OverflowDropNewest = iota // drop the message pushed
+	OverflowDropOldest        // drop the oldest message queued
+	OverflowDisconnect        // kick the slow session
+)
+
+var overflows = map[string]int{
+	"drop_newest": OverflowDropNewest,
+	"drop_oldest": OverflowDropOldest,
+	"disconnect":  OverflowDisconnect,
+}
+
+// ParseOverflow parse the overflow policy name, empty means drop_newest.
+func ParseOverflow(name string) (policy int, err error) {
+	if name == "" {
+		return OverflowDropNewest, nil
+	}
+	var ok bool
+	if policy, ok = overflows[name]; !ok {
+		err = fmt.Errorf("overflow \"%s\" not valid, must be drop_newest, drop_oldest or disconnect", name)
+	}
+	return
+}
+
 var (
-	ErrSessionFull = errors.New("session cache full")
+	ErrSessionFull   = errors.New("session cache full")
+	ErrSessionNoConn = errors.New("session without conn")
 )
 
 // Session used by message pusher send msg to write goroutine.
@@ -18,8 +49,24 @@ type Session struct {
 	ZoneId   int
 	CliProto utils.Ring
 	signal   chan *proto.Proto
+	closed   sync.Once
 	Writer   bufio.Writer
 	Reader   bufio.Reader
+
+	// set by the server after handshake
+	Uid      uint32
+	Device   string            // device id, same uid and device is a duplicate login
+	Platform string            // e.g. ios, android, web
+	Addr     string            // client address
+	Meta     map[string]string // auth metadata
+	Conn     io.Closer         // transport, closed by Kick
+
+	Overflow int  // overflow policy
+	Detached bool // no dispatch goroutine reads it (long polling)
+
+	roomLock   sync.Mutex
+	rooms      map[string]*Rooms // joined room ids and their shard
+	roomClosed bool              // removed from the zone, see LeaveRooms
 }
 
 // cli: recv cache size, svr: send cache size
@@ -32,15 +79,66 @@ func NewSession(id uint64, zid int, cli, svr int) *Session {
 	return c
 }
 
-// Push server push message.
+// Push server push message, a full session is handled by the overflow
+// policy, ErrSessionFull is returned if the message is not queued.
 func (c *Session) Push(p *proto.Proto) (e error) {
 	select {
 	case c.signal <- p:
+		return
 	default:
-		e = ErrSessionFull
-		log.Error("Session Cache Full %v:%v", c.ZoneId, c.Id)
 	}
-	return
+	switch c.Overflow {
+	case OverflowDropOldest:
+		var old *proto.Proto
+		select {
+		case old = <-c.signal:
+		default:
+		}
+		if old == proto.ProtoReady || old == proto.ProtoFinish {
+			// never drop a signal, put it back and drop the newest. it goes
+			// to the tail, the replies it signals wait the queued pushes.
+			c.requeue(old)
+			break
+		}
+		select {
+		case c.signal <- p:
+			stat.SlowStat.IncrDropOldest()
+			return
+		default:
+		}
+	case OverflowDisconnect:
+		log.Error("Session Cache Full %v:%v, disconnect", c.ZoneId, c.Id)
+		stat.SlowStat.IncrEvicted()
+		c.Kick()
+		return ErrSessionFull
+	}
+	stat.SlowStat.IncrDropNewest()
+	log.Error("Session Cache Full %v:%v", c.ZoneId, c.Id)
+	return ErrSessionFull
+}
+
+// requeue put the dequeued signal sig back without blocking, the caller may
+// hold a zone or room lock. If a concurrent push took the slot meanwhile the
+// oldest protos are dropped until it fits. A ready is kept once and not at
+// all once finished, a finish is never lost.
+func (c *Session) requeue(sig *proto.Proto) {
+	for {
+		select {
+		case c.signal <- sig:
+			return
+		default:
+		}
+		select {
+		case c.signal <- sig:
+			return
+		case p := <-c.signal:
+			if p == proto.ProtoFinish {
+				sig = p
+			} else if p != proto.ProtoReady {
+				stat.SlowStat.IncrDropOldest()
+			}
+		}
+	}
 }
 
 // Ready check the session ready or close?
@@ -48,12 +146,96 @@ func (c *Session) Ready() *proto.Proto {
 	return <-c.signal
 }
 
+// ReadyTimeout is Ready waiting at most timeout, nil if nothing comes. a
+// zero timeout never waits.
+func (c *Session) ReadyTimeout(timeout time.Duration) *proto.Proto {
+	if timeout <= 0 {
+		select {
+		case p := <-c.signal:
+			return p
+		default:
+			return nil
+		}
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case p := <-c.signal:
+		return p
+	case <-t.C:
+		return nil
+	}
+}
+
 // Signal send signal to the session, protocol ready.
 func (c *Session) Signal() {
 	c.signal <- proto.ProtoReady
 }
 
-// Close close the session.
+// Close close the session, only the first call takes effect, so a session
+// kicked by another goroutine can be closed again by its own. A detached
+// session never blocks, the oldest protos are dropped for the finish.
 func (c *Session) Close() {
-	c.signal <- proto.ProtoFinish
+	if c.Detached {
+		c.closed.Do(c.finish)
+		return
+	}
+	c.closed.Do(func() {
+		c.signal <- proto.ProtoFinish
+	})
+}
+
+// Discard drop the queued protos and close the session, for a session no
+// dispatch goroutine reads, so Close never blocks on a full cache.
+func (c *Session) Discard() {
+	for {
+		select {
+		case <-c.signal:
+		default:
+			c.closed.Do(c.finish)
+			return
+		}
+	}
+}
+
+// Finish queue the notice p if not nil and close the session without
+// blocking, the oldest protos are dropped until both fit. For a kicked
+// session, which client may be gone with a full cache.
+func (c *Session) Finish(p *proto.Proto) {
+	c.closed.Do(func() {
+		if p != nil {
+			c.force(p)
+		}
+		c.finish()
+	})
+}
+
+// finish queue ProtoFinish, dropping the oldest protos until it fits.
+func (c *Session) finish() {
+	c.force(proto.ProtoFinish)
+}
+
+// force queue p, dropping the oldest protos until it fits.
+func (c *Session) force(p *proto.Proto) {
+	for {
+		select {
+		case c.signal <- p:
+			return
+		default:
+		}
+		// full, a concurrent read may free a slot meanwhile
+		select {
+		case c.signal <- p:
+			return
+		case <-c.signal:
+		}
+	}
+}
+
+// Kick close the session transport, the serve goroutines exit by itself.
+func (c *Session) Kick() error {
+	if c.Conn == nil {
+		return ErrSessionNoConn
+	}
+	return c.Conn.Close()
 }
@@ -0,0 +1,107 @@
+package zone
+
+import (
+	"im/comet/proto"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionOverflow(t *testing.T) {
+	var (
+		p1 = &proto.Proto{SeqId: 1}
+		p2 = &proto.Proto{SeqId: 2}
+		p3 = &proto.Proto{SeqId: 3}
+	)
+	s := NewSession(1, 0, 1, 2)
+	s.Push(p1)
+	s.Push(p2)
+	if e := s.Push(p3); e != ErrSessionFull {
+		t.Fatalf("drop newest error(%v)", e)
+	}
+	if s.Ready() != p1 || s.Ready() != p2 {
+		t.FailNow()
+	}
+
+	s = NewSession(1, 0, 1, 2)
+	s.Overflow = OverflowDropOldest
+	s.Push(p1)
+	s.Push(p2)
+	if e := s.Push(p3); e != nil {
+		t.Fatalf("drop oldest error(%v)", e)
+	}
+	if s.Ready() != p2 || s.Ready() != p3 {
+		t.FailNow()
+	}
+
+	s = NewSession(1, 0, 1, 2)
+	s.Overflow = OverflowDropOldest
+	s.Signal()
+	s.Push(p1)
+	if e := s.Push(p2); e != ErrSessionFull {
+		t.Fatalf("drop oldest signal error(%v)", e)
+	}
+	if s.Ready() != p1 || s.Ready() != proto.ProtoReady {
+		t.FailNow()
+	}
+}
+
+func TestSessionOverflowNoBlock(t *testing.T) {
+	for _, sig := range []*proto.Proto{proto.ProtoReady, proto.ProtoFinish} {
+		var (
+			wg   sync.WaitGroup
+			done = make(chan struct{})
+			s    = NewSession(1, 0, 1, 1)
+			n    = runtime.NumGoroutine()
+		)
+		s.Overflow = OverflowDropOldest
+		s.signal <- sig
+		// nobody reads, concurrent pushes race for the slot of the signal
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func() {
+				s.Push(&proto.Proto{})
+				wg.Done()
+			}()
+		}
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("push blocked on a full session")
+		}
+		// the signal is never lost and nothing is left behind
+		if p := s.Ready(); p != sig {
+			t.Fatalf("signal lost, got %v", p)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if m := runtime.NumGoroutine(); m > n {
+			t.Fatalf("goroutines %d, was %d", m, n)
+		}
+	}
+}
+
+func TestSessionFinish(t *testing.T) {
+	var (
+		p1     = &proto.Proto{SeqId: 1}
+		p2     = &proto.Proto{SeqId: 2}
+		notice = &proto.Proto{SeqId: 3}
+		s      = NewSession(1, 0, 1, 2)
+	)
+	s.Push(p1)
+	s.Push(p2)
+	// full and nobody reads, the oldest are dropped
+	s.Finish(notice)
+	s.Finish(nil)
+	s.Close()
+	if s.Ready() != notice || s.Ready() != proto.ProtoFinish {
+		t.FailNow()
+	}
+	if s.ReadyTimeout(0) != nil {
+		t.Fatal("finished twice")
+	}
+}
@@ -1,20 +1,53 @@
 package zone
 
 import (
+	"errors"
 	"fmt"
 	"im/comet/proto"
 	"sync"
 	"im/comet/stat"
 )
 
+// duplicate login policy, for a session of a uid and device already in the
+// zone
+const (
+	DupLoginKick   = iota // kick the old sessions
+	DupLoginReject        // reject the new session
+	DupLoginAllow         // keep all, as separate device sessions
+)
+
+var dupLogins = map[string]int{
+	"kick":   DupLoginKick,
+	"reject": DupLoginReject,
+	"allow":  DupLoginAllow,
+}
+
+// ParseDupLogin parse the duplicate login policy name, empty means kick.
+func ParseDupLogin(name string) (policy int, err error) {
+	if name == "" {
+		return DupLoginKick, nil
+	}
+	var ok bool
+	if policy, ok = dupLogins[name]; !ok {
+		err = fmt.Errorf("dup_login \"%s\" not valid, must be kick, reject or allow", name)
+	}
+	return
+}
+
+var (
+	ErrSessionNotFound  = errors.New("session not found")
+	ErrSessionDuplicate = errors.New("session duplicate login")
+)
+
 type ZoneOptions struct {
 	CacheSize int
 }
 
 type Zone struct {
 	rLock    sync.RWMutex
-	Id  int
+	Id       int
 	sessions map[uint64]*Session
+	users    map[uint32]map[uint64]*Session // uid index of sessions
 }
 
 // NewZone new a zone struct, store session zone info.
@@ -22,6 +55,7 @@ func NewZone(i int, zoption ZoneOptions) (r *Zone) {
 	r = new(Zone)
 	r.Id = i
 	r.sessions = make(map[uint64]*Session, zoption.CacheSize) //
+	r.users = make(map[uint32]map[uint64]*Session, zoption.CacheSize)
 	return
 }
 
@@ -37,10 +71,31 @@ func (r *Zone) Session(id uint64) (session *Session, e error) {
 	return
 }
 
-// Put put session into the zone.
-func (r *Zone) Put(session *Session) {
+// Put put session into the zone, a session of the same uid and device
+// already in is handled by the duplicate login policy. The kicked sessions
+// are removed from the zone and returned, the caller must close them.
+func (r *Zone) Put(session *Session, policy int) (kicked []*Session, e error) {
 	r.rLock.Lock()
+	olds := r.users[session.Uid]
+	if policy != DupLoginAllow {
+		for id, old := range olds {
+			if old.Device != session.Device {
+				continue
+			}
+			if policy == DupLoginReject {
+				r.rLock.Unlock()
+				return nil, ErrSessionDuplicate
+			}
+			kicked = append(kicked, old)
+			r.del(id)
+		}
+	}
 	r.sessions[session.Id] = session
+	if olds = r.users[session.Uid]; olds == nil {
+		olds = make(map[uint64]*Session)
+		r.users[session.Uid] = olds
+	}
+	olds[session.Id] = session
 	stat.SvrZones.IncrAdd(r.Id)
 	r.rLock.Unlock()
 	return
@@ -49,27 +104,96 @@ func (r *Zone) Put(session *Session) {
 // Del delete session from the zone.
 func (r *Zone) Del(id uint64) {
 	r.rLock.Lock()
-	if _, ok := r.sessions[id]; ok {
-		delete(r.sessions, id)
-		stat.SvrZones.IncrRemove(r.Id)
-	}
+	r.del(id)
 	r.rLock.Unlock()
 }
 
+// del must be called with rLock held.
+func (r *Zone) del(id uint64) {
+	session, ok := r.sessions[id]
+	if !ok {
+		return
+	}
+	delete(r.sessions, id)
+	session.LeaveRooms()
+	if olds := r.users[session.Uid]; olds != nil {
+		if delete(olds, id); len(olds) == 0 {
+			delete(r.users, session.Uid)
+		}
+	}
+	stat.SvrZones.IncrRemove(r.Id)
+}
+
 // Push push msg
-func (r *Zone) Push(id uint64, p *proto.Proto) {
+func (r *Zone) Push(id uint64, p *proto.Proto) (e error) {
 	r.rLock.RLock()
 	if session, ok := r.sessions[id]; ok {
-		session.Push(p)
+		e = session.Push(p)
+	} else {
+		e = ErrSessionNotFound
 	}
 	r.rLock.RUnlock()
+	return
 }
 
-// Close close the room.
-func (r *Zone) Close() {
+// PushUser push msg to every session of uid, only the ones on platform if
+// it is not empty. Returns the number of sessions queued it.
+func (r *Zone) PushUser(uid uint32, platform string, p *proto.Proto) (n int, e error) {
+	e = ErrSessionNotFound
+	r.rLock.RLock()
+	for _, session := range r.users[uid] {
+		if platform == "" || session.Platform == platform {
+			if session.Push(p) == nil {
+				n++
+			}
+			e = nil
+		}
+	}
+	r.rLock.RUnlock()
+	return
+}
+
+// PushDevice push msg to the sessions of uid on device. Returns the number
+// of sessions queued it.
+func (r *Zone) PushDevice(uid uint32, device string, p *proto.Proto) (n int, e error) {
+	e = ErrSessionNotFound
+	r.rLock.RLock()
+	for _, session := range r.users[uid] {
+		if session.Device == device {
+			if session.Push(p) == nil {
+				n++
+			}
+			e = nil
+		}
+	}
+	r.rLock.RUnlock()
+	return
+}
+
+// Sessions get a snapshot of the sessions in the zone.
+func (r *Zone) Sessions() (sessions []*Session) {
 	r.rLock.RLock()
+	sessions = make([]*Session, 0, len(r.sessions))
 	for _, session := range r.sessions {
-		session.Close()
+		sessions = append(sessions, session)
+	}
+	r.rLock.RUnlock()
+	return
+}
+
+// PushAll push msg to every session in the zone.
+func (r *Zone) PushAll(p *proto.Proto) {
+	r.rLock.RLock()
+	for _, session := range r.sessions {
+		session.Push(p)
 	}
 	r.rLock.RUnlock()
 }
+
+// Close close the room. The sessions are closed out of the lock, a closing
+// session may delete itself from the zone.
+func (r *Zone) Close() {
+	for _, session := range r.Sessions() {
+		session.Close()
+	}
+}
@@ -0,0 +1,74 @@
+package zone
+
+import (
+	"im/comet/proto"
+	"im/comet/stat"
+	"testing"
+)
+
+func TestZonePutDupLogin(t *testing.T) {
+	stat.SvrZones = stat.NewZonesStat(1)
+	z := NewZone(0, ZoneOptions{CacheSize: 4})
+	s1 := NewSession(1, 0, 1, 2)
+	s1.Uid = 7
+	if kicked, e := z.Put(s1, DupLoginKick); e != nil || len(kicked) != 0 {
+		t.Fatalf("put first kicked %v error(%v)", kicked, e)
+	}
+
+	s2 := NewSession(2, 0, 1, 2)
+	s2.Uid = 7
+	if _, e := z.Put(s2, DupLoginReject); e != ErrSessionDuplicate {
+		t.Fatalf("reject error(%v)", e)
+	}
+	if _, e := z.Session(2); e == nil {
+		t.Fatal("rejected session put")
+	}
+	if _, e := z.Put(s2, DupLoginAllow); e != nil {
+		t.Fatalf("allow error(%v)", e)
+	}
+
+	s3 := NewSession(3, 0, 1, 2)
+	s3.Uid = 7
+	kicked, e := z.Put(s3, DupLoginKick)
+	if e != nil || len(kicked) != 2 {
+		t.Fatalf("kick kicked %v error(%v)", kicked, e)
+	}
+	if _, e = z.Session(1); e == nil {
+		t.Error("kicked session still in zone")
+	}
+	// the kicked session deletes itself later, must not remove the new one
+	z.Del(1)
+	if len(z.users[7]) != 1 {
+		t.Errorf("uid sessions %d, want 1", len(z.users[7]))
+	}
+	z.Del(3)
+	if _, ok := z.users[7]; ok {
+		t.Error("empty uid index not deleted")
+	}
+}
+
+func TestZonePushDevice(t *testing.T) {
+	stat.SvrZones = stat.NewZonesStat(1)
+	z := NewZone(0, ZoneOptions{CacheSize: 4})
+	phone := NewSession(1, 0, 1, 4)
+	phone.Uid, phone.Device, phone.Platform = 7, "p1", "ios"
+	web := NewSession(2, 0, 1, 4)
+	web.Uid, web.Device, web.Platform = 7, "w1", "web"
+	z.Put(phone, DupLoginKick)
+	// another device is not a duplicate login
+	if kicked, _ := z.Put(web, DupLoginKick); len(kicked) != 0 {
+		t.Fatalf("kicked %v", kicked)
+	}
+	if _, e := z.PushUser(7, "", &proto.Proto{}); e != nil || len(phone.signal) != 1 || len(web.signal) != 1 {
+		t.Fatalf("push user error(%v)", e)
+	}
+	if _, e := z.PushUser(7, "web", &proto.Proto{}); e != nil || len(phone.signal) != 1 || len(web.signal) != 2 {
+		t.Fatalf("push platform error(%v)", e)
+	}
+	if _, e := z.PushDevice(7, "p1", &proto.Proto{}); e != nil || len(phone.signal) != 2 || len(web.signal) != 2 {
+		t.Fatalf("push device error(%v)", e)
+	}
+	if _, e := z.PushDevice(7, "t1", &proto.Proto{}); e != ErrSessionNotFound {
+		t.Fatalf("push absent device error(%v)", e)
+	}
+}
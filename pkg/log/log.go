@@ -3,19 +3,61 @@ package log
 import (
 	"fmt"
 	"strings"
+	"sync/atomic"
 )
 
+const (
+	DEBUG = iota
+	INFO
+	WARN
+	ERROR
+)
+
+var (
+	level  int32 = DEBUG
+	levels       = map[string]int32{"debug": DEBUG, "info": INFO, "warn": WARN, "error": ERROR}
+)
+
+// SetLevel set the min level printed, one of debug, info, warn, error.
+// empty means debug.
+func SetLevel(name string) (err error) {
+	if name == "" {
+		name = "debug"
+	}
+	if l, ok := levels[strings.ToLower(name)]; ok {
+		atomic.StoreInt32(&level, l)
+	} else {
+		err = fmt.Errorf("log level \"%s\" not valid", name)
+	}
+	return
+}
+
+// ValidLevel check the level name without set.
+func ValidLevel(name string) bool {
+	_, ok := levels[strings.ToLower(name)]
+	return ok || name == ""
+}
+
 func Debug(formate string, args ...interface{}) {
+	if atomic.LoadInt32(&level) > DEBUG {
+		return
+	}
 	v := fmt.Sprintf(formate, args...)
 	p(v)
 }
 
 func Info(formate string, args ...interface{}) {
+	if atomic.LoadInt32(&level) > INFO {
+		return
+	}
 	v := fmt.Sprintf(formate, args...)
 	p(v)
 }
 
 func Warn(formate string, args ...interface{}) {
+	if atomic.LoadInt32(&level) > WARN {
+		return
+	}
 	v := fmt.Sprintf(formate, args...)
 	p(v)
 }
@@ -29,5 +71,3 @@ func p(value string) {
 	v := strings.Trim(value, "\n")
 	fmt.Println(v)
 }
-
-
@@ -0,0 +1,66 @@
+package net
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// CIDRs is a list of ip networks.
+type CIDRs []*net.IPNet
+
+// ParseCIDRs parse cidrs like "10.0.0.0/8", a bare ip is a single host.
+func ParseCIDRs(list []string) (cidrs CIDRs, err error) {
+	var ipnet *net.IPNet
+	for _, s := range list {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				err = fmt.Errorf("cidr: \"%s\" error, not an ip", s)
+				return
+			}
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		if _, ipnet, err = net.ParseCIDR(s); err != nil {
+			return
+		}
+		cidrs = append(cidrs, ipnet)
+	}
+	return
+}
+
+// Contains check the ip in any of the cidrs.
+func (cidrs CIDRs) Contains(ip net.IP) bool {
+	for _, ipnet := range cidrs {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsAddr check the ip of a tcp or udp addr in any of the cidrs.
+func (cidrs CIDRs) ContainsAddr(addr net.Addr) bool {
+	if ip := AddrIP(addr); ip != nil {
+		return cidrs.Contains(ip)
+	}
+	return false
+}
+
+// AddrIP get the ip of a tcp or udp addr, nil for the others.
+func AddrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// handoffEnv pass the binds of the inherited listeners to the child,
+	// the i-th bind is the fd 3+i.
+	handoffEnv     = "COMET_LISTEN_BINDS"
+	handoffSpliter = ";"
+	// handoffReadyEnv pass the fd the child writes once ready, see Ready.
+	handoffReadyEnv     = "COMET_READY_FD"
+	handoffReadyTimeout = 30 * time.Second
+)
+
+var (
+	ErrNotReady = errors.New("new process exited before ready")
+)
+
+var (
+	handoffLock sync.Mutex
+	readyFile   *os.File                    // to the parent, see Ready
+	inherited   = map[string]net.Listener{} // from the parent, by bind
+	listeners   = map[string]net.Listener{} // opened by Listen, by bind
+)
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Inherit take the listeners passed by the parent in StartProcess, Listen
+// returns them instead of binding again, and keep the fd for Ready. It must
+// be called before any Listen.
+func Inherit() (n int, err error) {
+	var (
+		i     int
+		bind  string
+		l     net.Listener
+		f     *os.File
+		binds = os.Getenv(handoffEnv)
+		ready = os.Getenv(handoffReadyEnv)
+	)
+	handoffLock.Lock()
+	defer handoffLock.Unlock()
+	if fd, e := strconv.Atoi(ready); e == nil && fd > 2 {
+		readyFile = os.NewFile(uintptr(fd), "ready")
+	}
+	os.Unsetenv(handoffReadyEnv)
+	if binds == "" {
+		return
+	}
+	os.Unsetenv(handoffEnv)
+	for i, bind = range strings.Split(binds, handoffSpliter) {
+		f = os.NewFile(uintptr(3+i), bind)
+		l, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			err = fmt.Errorf("inherit listener \"%s\" error(%v)", bind, err)
+			return
+		}
+		inherited[bind] = l
+		n++
+	}
+	return
+}
+
+// CloseInherited close the inherited listeners not taken by Listen, which
+// binds were removed from the config.
+func CloseInherited() {
+	handoffLock.Lock()
+	for bind, l := range inherited {
+		l.Close()
+		delete(inherited, bind)
+	}
+	handoffLock.Unlock()
+}
+
+// StartProcess exec the same binary with the same args and env, passing
+// every listener opened by Listen, and wait until the child calls Ready. If
+// the child exits or is not ready in handoffReadyTimeout it is killed and an
+// error is returned, the caller keeps serving. Otherwise the caller should
+// stop accepting and drain the sessions it has.
+func StartProcess() (p *os.Process, err error) {
+	var (
+		l     net.Listener
+		f     *os.File
+		r, w  *os.File
+		files []*os.File
+		binds string
+		argv0 string
+	)
+	if argv0, err = os.Executable(); err != nil {
+		return
+	}
+	if r, w, err = os.Pipe(); err != nil {
+		return
+	}
+	defer r.Close()
+	handoffLock.Lock()
+	files, binds = handoffFiles()
+	handoffLock.Unlock()
+	attr := &os.ProcAttr{
+		Env: append(os.Environ(), handoffEnv+"="+binds,
+			fmt.Sprintf("%s=%d", handoffReadyEnv, 3+len(files))),
+		Files: append(append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...), w),
+	}
+	p, err = os.StartProcess(argv0, os.Args, attr)
+	// the write end must be closed here, a child gone is read as EOF
+	for _, f = range append(files, w) {
+		f.Close()
+	}
+	if err != nil {
+		return
+	}
+	if err = waitReady(r, handoffReadyTimeout); err != nil {
+		p.Kill()
+		p.Wait()
+		return nil, err
+	}
+	handoffLock.Lock()
+	// the socket file now belongs to the child too
+	for _, l = range listeners {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	handoffLock.Unlock()
+	return
+}
+
+// Ready tell the parent in StartProcess the inherited listeners are served,
+// nothing is done if the process was not started by StartProcess.
+func Ready() (err error) {
+	handoffLock.Lock()
+	f := readyFile
+	readyFile = nil
+	handoffLock.Unlock()
+	if f == nil {
+		return
+	}
+	_, err = f.Write([]byte{1})
+	f.Close()
+	return
+}
+
+// waitReady wait the child write the ready byte to r.
+func waitReady(r *os.File, timeout time.Duration) (err error) {
+	b := make([]byte, 1)
+	r.SetReadDeadline(time.Now().Add(timeout))
+	if _, err = r.Read(b); err == io.EOF {
+		err = ErrNotReady
+	}
+	return
+}
+
+// handoffFiles dup the listeners opened by Listen, the i-th file is passed
+// as the fd 3+i and binds is the handoffEnv value. Called under handoffLock,
+// the caller closes the files.
+func handoffFiles() (files []*os.File, binds string) {
+	var bs []string
+	for bind, l := range listeners {
+		fl, ok := l.(filer)
+		if !ok {
+			continue
+		}
+		// closed listeners are skipped
+		f, err := fl.File()
+		if err != nil {
+			delete(listeners, bind)
+			continue
+		}
+		files = append(files, f)
+		bs = append(bs, bind)
+	}
+	binds = strings.Join(bs, handoffSpliter)
+	return
+}
@@ -0,0 +1,128 @@
+package net
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestHandoff pass the listeners to a child as StartProcess does, the child
+// must be ready and accept on every bind, a child exited is never ready.
+func TestHandoff(t *testing.T) {
+	var (
+		addrs []net.Addr
+		path  = filepath.Join(os.TempDir(), "comet-handoff-test.sock")
+	)
+	for _, bind := range []string{"127.0.0.1:0", "unix@" + path} {
+		l, err := Listen(bind)
+		if err != nil {
+			t.Fatalf("Listen(\"%s\") error(%v)", bind, err)
+		}
+		defer l.Close()
+		addrs = append(addrs, l.Addr())
+	}
+	handoffLock.Lock()
+	files, binds := handoffFiles()
+	handoffLock.Unlock()
+	for _, f := range files {
+		defer f.Close()
+	}
+	if len(files) != 2 {
+		t.Fatalf("handoff files %d, want 2", len(files))
+	}
+	// a child exited before ready
+	cmd, r := testHandoffChild(t, files, binds, "-test.list=^$")
+	if err := waitReady(r, 5*time.Second); err != ErrNotReady {
+		t.Fatalf("exited child ready error(%v)", err)
+	}
+	r.Close()
+	cmd.Wait()
+
+	cmd, r = testHandoffChild(t, files, binds, "-test.run=^TestHandoffChild$")
+	defer r.Close()
+	if err := waitReady(r, 5*time.Second); err != nil {
+		t.Fatalf("child ready error(%v)", err)
+	}
+	for _, addr := range addrs {
+		c, err := net.DialTimeout(addr.Network(), addr.String(), time.Second)
+		if err != nil {
+			t.Fatalf("dial %s error(%v)", addr, err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		line, err := bufio.NewReader(c).ReadString('\n')
+		c.Close()
+		if err != nil || !strings.HasPrefix(line, "inherited ") {
+			t.Fatalf("%s reply \"%s\" error(%v)", addr, line, err)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("child error(%v)", err)
+	}
+}
+
+// testHandoffChild start the test binary with args as StartProcess does, r
+// is read for Ready.
+func testHandoffChild(t *testing.T, files []*os.File, binds string, args ...string) (cmd *exec.Cmd, r *os.File) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	cmd = exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), handoffEnv+"="+binds, fmt.Sprintf("%s=%d", handoffReadyEnv, 3+len(files)))
+	// ExtraFiles[i] is the fd 3+i
+	cmd.ExtraFiles = append(append([]*os.File{}, files...), w)
+	cmd.Stderr = os.Stderr
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// TestHandoffChild is the child of TestHandoff.
+func TestHandoffChild(t *testing.T) {
+	binds := os.Getenv(handoffEnv)
+	if binds == "" {
+		t.Skip("run by TestHandoff")
+	}
+	n, err := Inherit()
+	if err != nil || n != 2 {
+		t.Fatalf("Inherit() %d error(%v)", n, err)
+	}
+	if os.Getenv(handoffEnv) != "" {
+		t.Fatal("handoff env not unset")
+	}
+	var (
+		wg sync.WaitGroup
+		ls = map[string]net.Listener{}
+	)
+	for _, bind := range strings.Split(binds, handoffSpliter) {
+		if ls[bind], err = Listen(bind); err != nil {
+			t.Fatalf("Listen(\"%s\") error(%v)", bind, err)
+		}
+	}
+	if err = Ready(); err != nil {
+		t.Fatalf("Ready() error(%v)", err)
+	}
+	for bind, l := range ls {
+		wg.Add(1)
+		go func(bind string, l net.Listener) {
+			defer wg.Done()
+			c, err := l.Accept()
+			if err != nil {
+				t.Errorf("accept %s error(%v)", bind, err)
+				return
+			}
+			c.Write([]byte("inherited " + bind + "\n"))
+			c.Close()
+		}(bind, l)
+	}
+	wg.Wait()
+}
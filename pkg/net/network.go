@@ -1,7 +1,10 @@
 package net
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"os"
 	"strings"
 )
 
@@ -9,6 +12,10 @@ const (
 	networkSpliter = "@"
 )
 
+var (
+	ErrAddrInUse = errors.New("address in use")
+)
+
 func ParseNetwork(str string) (network, addr string, err error) {
 	if idx := strings.Index(str, networkSpliter); idx == -1 {
 		err = fmt.Errorf("addr: \"%s\" error, must be network@tcp:port or network@unixsocket", str)
@@ -19,3 +26,53 @@ func ParseNetwork(str string) (network, addr string, err error) {
 		return
 	}
 }
+
+// Listen announce on a bind, "network@addr" or a bare "host:port" which is
+// dual-stack tcp ("[::1]:8080" for an ipv6 host). a stale unix socket file
+// left by a crashed process is removed first, any other file or a socket
+// served by another process is ErrAddrInUse. a listener inherited from the
+// parent process on the same bind is returned instead, see Inherit.
+func Listen(bind string) (l net.Listener, err error) {
+	var network, addr = "tcp", bind
+	handoffLock.Lock()
+	defer handoffLock.Unlock()
+	if l = inherited[bind]; l != nil {
+		delete(inherited, bind)
+		listeners[bind] = l
+		return
+	}
+	if strings.Contains(bind, networkSpliter) {
+		if network, addr, err = ParseNetwork(bind); err != nil {
+			return
+		}
+	}
+	if network == "unix" {
+		if err = removeStaleSocket(addr); err != nil {
+			return
+		}
+	}
+	if l, err = net.Listen(network, addr); err != nil {
+		return
+	}
+	listeners[bind] = l
+	return
+}
+
+// removeStaleSocket remove the unix socket file at addr if nobody serves it.
+func removeStaleSocket(addr string) (err error) {
+	var fi os.FileInfo
+	if fi, err = os.Lstat(addr); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return ErrAddrInUse
+	}
+	if c, e := net.Dial("unix", addr); e == nil {
+		c.Close()
+		return ErrAddrInUse
+	}
+	return os.Remove(addr)
+}
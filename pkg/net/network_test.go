@@ -0,0 +1,45 @@
+package net
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListen(t *testing.T) {
+	l, err := Listen("[::1]:0")
+	if err != nil {
+		t.Logf("ipv6 unavailable: %v", err)
+	} else {
+		l.Close()
+	}
+	path := filepath.Join(os.TempDir(), "comet-listen-test.sock")
+	os.Remove(path)
+	// a regular file is never removed
+	if f, err := os.Create(path); err == nil {
+		f.Close()
+	}
+	if _, err = Listen("unix@" + path); err != ErrAddrInUse {
+		t.Fatalf("Listen(unix) on a file error(%v)", err)
+	}
+	os.Remove(path)
+	// a stale socket file left by a crash must not fail the bind
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ul.SetUnlinkOnClose(false)
+	ul.Close()
+	if l, err = Listen("unix@" + path); err != nil {
+		t.Fatalf("Listen(unix) error(%v)", err)
+	}
+	defer l.Close()
+	if l.Addr().Network() != "unix" {
+		t.Errorf("network %s, want unix", l.Addr().Network())
+	}
+	// the socket of a live process is never removed
+	if _, err = Listen("unix@" + path); err != ErrAddrInUse {
+		t.Fatalf("Listen(unix) on a live socket error(%v)", err)
+	}
+}
@@ -0,0 +1,188 @@
+// Package proxyproto read the PROXY protocol v1 and v2 header sent by a L4
+// load balancer before the client data, so the server sees the real client
+// address. see https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	inet "im/pkg/net"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	v1MaxLen = 107
+	v2HdrLen = 16
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	ErrUntrusted = errors.New("proxy protocol from untrusted source")
+	ErrHeader    = errors.New("proxy protocol header error")
+)
+
+// Listener wrap a listener, the header of an accepted conn is read lazily
+// by its first Read or RemoteAddr, which must be in the conn own goroutine.
+type Listener struct {
+	net.Listener
+	Trusted inet.CIDRs    // empty trust none
+	Timeout time.Duration // header read deadline, 0 none
+}
+
+func (l *Listener) Accept() (c net.Conn, err error) {
+	if c, err = l.Listener.Accept(); err != nil {
+		return
+	}
+	return NewConn(c, l.Trusted, l.Timeout), nil
+}
+
+// Conn is a net.Conn whose RemoteAddr is the client address in the header.
+type Conn struct {
+	net.Conn
+	trusted inet.CIDRs
+	timeout time.Duration
+	once    sync.Once
+	r       *bufio.Reader
+	remote  net.Addr // nil if the header has no address
+	err     error
+}
+
+// NewConn new a conn, the header is read by Handshake or the first Read or
+// RemoteAddr.
+func NewConn(c net.Conn, trusted inet.CIDRs, timeout time.Duration) *Conn {
+	return &Conn{Conn: c, trusted: trusted, timeout: timeout}
+}
+
+// Handshake read the header once, conns from untrusted sources are
+// rejected with ErrUntrusted, an empty trusted list trusts none.
+func (c *Conn) Handshake() error {
+	c.once.Do(func() {
+		if !c.trusted.ContainsAddr(c.Conn.RemoteAddr()) {
+			c.err = ErrUntrusted
+			return
+		}
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.r = bufio.NewReaderSize(c.Conn, 256)
+		c.remote, c.err = readHeader(c.r)
+	})
+	return c.err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr get the client address, the proxy address if no header.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.Handshake() == nil && c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// ProxyAddr get the address of the proxy.
+func (c *Conn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+func readHeader(r *bufio.Reader) (addr net.Addr, err error) {
+	var buf []byte
+	if buf, err = r.Peek(len(v2Signature)); err != nil {
+		return
+	}
+	if bytes.Equal(buf, v2Signature) {
+		return readV2(r)
+	}
+	if bytes.HasPrefix(buf, v1Prefix) {
+		return readV1(r)
+	}
+	return nil, ErrHeader
+}
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readV1(r *bufio.Reader) (addr net.Addr, err error) {
+	var (
+		line []byte
+		port int
+	)
+	if line, err = r.ReadSlice('\n'); err != nil {
+		if err == bufio.ErrBufferFull {
+			err = ErrHeader
+		}
+		return
+	}
+	if len(line) > v1MaxLen || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrHeader
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, ErrHeader
+	}
+	if port, err = strconv.Atoi(fields[4]); err != nil || port < 0 || port > 65535 {
+		return nil, ErrHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readV2(r *bufio.Reader) (addr net.Addr, err error) {
+	var (
+		hdr  [v2HdrLen]byte
+		body []byte
+	)
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, ErrHeader
+	}
+	body = make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+	// LOCAL command, health check of the proxy itself
+	if hdr[12]&0xf == 0 {
+		return nil, nil
+	}
+	if hdr[12]&0xf != 1 {
+		return nil, ErrHeader
+	}
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET: src, dst, src port, dst port
+		if len(body) < 12 {
+			return nil, ErrHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, ErrHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	// AF_UNSPEC, AF_UNIX
+	return nil, nil
+}
@@ -0,0 +1,85 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	inet "im/pkg/net"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+var loopback, _ = inet.ParseCIDRs([]string{"127.0.0.0/8"})
+
+func testConn(t *testing.T, header []byte, trusted inet.CIDRs) (c *Conn, data []byte, err error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		client.Write(append(header, "hello"...))
+		client.Close()
+	}()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	c = NewConn(server, trusted, 0)
+	if err = c.Handshake(); err != nil {
+		return
+	}
+	data, err = ioutil.ReadAll(c)
+	return
+}
+
+func TestV1(t *testing.T) {
+	c, data, err := testConn(t, []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"), loopback)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("read %s error(%v)", data, err)
+	}
+	if addr := c.RemoteAddr().String(); addr != "192.168.0.1:56324" {
+		t.Fatalf("remote addr %s", addr)
+	}
+	c, data, err = testConn(t, []byte("PROXY UNKNOWN\r\n"), loopback)
+	if err != nil || string(data) != "hello" || c.RemoteAddr() != c.ProxyAddr() {
+		t.Fatalf("unknown read %s error(%v)", data, err)
+	}
+	if _, _, err = testConn(t, []byte("GET / HTTP/1.1\r\n"), loopback); err != ErrHeader {
+		t.Fatalf("no header error(%v)", err)
+	}
+}
+
+func TestV2(t *testing.T) {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x21, 0x21, 0, 36)
+	header = append(header, net.ParseIP("2001:db8::1")...)
+	header = append(header, net.ParseIP("2001:db8::2")...)
+	header = append(header, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-4:], 1234)
+	c, data, err := testConn(t, header, loopback)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("read %s error(%v)", data, err)
+	}
+	if addr := c.RemoteAddr().String(); addr != "[2001:db8::1]:1234" {
+		t.Fatalf("remote addr %s", addr)
+	}
+}
+
+func TestUntrusted(t *testing.T) {
+	trusted, err := inet.ParseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = testConn(t, []byte("PROXY UNKNOWN\r\n"), trusted); err != ErrUntrusted {
+		t.Fatalf("untrusted error(%v)", err)
+	}
+	// fail closed, no source trusted
+	if _, _, err = testConn(t, []byte("PROXY UNKNOWN\r\n"), nil); err != ErrUntrusted {
+		t.Fatalf("empty trusted error(%v)", err)
+	}
+}
@@ -0,0 +1,45 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	ErrReusePort = errors.New("SO_REUSEPORT not supported")
+)
+
+// ListenReusePort open n SO_REUSEPORT tcp listeners on the same bind, the
+// kernel spreads new connections across them. Inherited listeners are taken
+// like Listen, keyed by "bind#i".
+func ListenReusePort(bind string, n int) (ls []net.Listener, err error) {
+	var (
+		i   int
+		key string
+		l   net.Listener
+		lc  = net.ListenConfig{Control: reusePort}
+	)
+	if strings.Contains(bind, networkSpliter) {
+		return nil, fmt.Errorf("addr: \"%s\" error, SO_REUSEPORT needs a tcp bind", bind)
+	}
+	handoffLock.Lock()
+	defer handoffLock.Unlock()
+	for i = 0; i < n; i++ {
+		key = fmt.Sprintf("%s#%d", bind, i)
+		if l = inherited[key]; l != nil {
+			delete(inherited, key)
+		} else if l, err = lc.Listen(context.Background(), "tcp", bind); err != nil {
+			for i, l = range ls {
+				l.Close()
+				delete(listeners, fmt.Sprintf("%s#%d", bind, i))
+			}
+			return nil, err
+		}
+		listeners[key] = l
+		ls = append(ls, l)
+	}
+	return
+}
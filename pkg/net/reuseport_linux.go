@@ -0,0 +1,17 @@
+package net
+
+import (
+	"syscall"
+)
+
+// SO_REUSEPORT, missing in package syscall on linux.
+const soReusePort = 0xf
+
+func reusePort(network, address string, c syscall.RawConn) (err error) {
+	if e := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); e != nil {
+		return e
+	}
+	return
+}
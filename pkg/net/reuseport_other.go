@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package net
+
+import (
+	"syscall"
+)
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return ErrReusePort
+}
@@ -2,23 +2,62 @@ package pprof
 
 import (
 	"im/pkg/log"
+	inet "im/pkg/net"
 	"net/http"
 	"net/http/pprof"
+	"sync"
+)
+
+var (
+	lock    sync.Mutex
+	servers = map[string]*http.Server{}
 )
 
 // StartPprof start http pprof.
 func Init(pprofBind []string) {
+	Reload(pprofBind)
+}
+
+// Reload listen the new pprof binds and close the removed ones.
+func Reload(pprofBind []string) {
+	var (
+		addr string
+		keep = map[string]bool{}
+	)
+	for _, addr = range pprofBind {
+		keep[addr] = true
+	}
+	lock.Lock()
+	for addr, server := range servers {
+		if !keep[addr] {
+			server.Close()
+			delete(servers, addr)
+		}
+	}
+	for _, addr = range pprofBind {
+		if _, ok := servers[addr]; !ok {
+			listen(addr)
+		}
+	}
+	lock.Unlock()
+}
+
+func listen(addr string) {
 	pprofServeMux := http.NewServeMux()
 	pprofServeMux.HandleFunc("/debug/pprof/", pprof.Index)
 	pprofServeMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	pprofServeMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	pprofServeMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	for _, addr := range pprofBind {
-		go func() {
-			if err := http.ListenAndServe(addr, pprofServeMux); err != nil {
-				log.Error("http.ListenAndServe(\"%s\", pprofServeMux) error(%v)", addr, err)
-				panic(err)
-			}
-		}()
+	l, err := inet.Listen(addr)
+	if err != nil {
+		log.Error("inet.Listen(\"%s\") error(%v)", addr, err)
+		return
 	}
+	server := &http.Server{Handler: pprofServeMux}
+	servers[addr] = server
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Error("pprof server.Serve(\"%s\") error(%v)", addr, err)
+		}
+	}()
 }
@@ -6,12 +6,14 @@ import (
 	"errors"
 	"net"
 	"os"
+	"strconv"
 	"yaml"
 )
 
 type Address struct {
 	Ip   string "ip"
 	Port int    "port"
+	Unix string "unix" // unix socket path, ip and port are ignored if set
 }
 
 type Addresses []Address
@@ -34,19 +36,24 @@ type RedisType2 struct {
 	IndexList string    "indexlist"
 }
 
+// String format the address as "host:port", an ipv6 host is bracketed. a
+// unix socket is formatted as "unix@path", see im/pkg/net.ParseNetwork.
 func (a *Address) String(lookup ...bool) string {
+	if a.Unix != "" {
+		return "unix@" + a.Unix
+	}
 	if a.Ip == "0.0.0.0" {
 		return fmt.Sprintf(":%v", a.Port)
 	}
 	if len(lookup) > 0 && lookup[0] == false {
-		return fmt.Sprintf("%s:%v", a.Ip, a.Port)
+		return net.JoinHostPort(a.Ip, strconv.Itoa(a.Port))
 	}
 
 	ip, e := net.LookupIP(a.Ip)
 	if e != nil {
-		return fmt.Sprintf("%s:%v", a.Ip, a.Port)
+		return net.JoinHostPort(a.Ip, strconv.Itoa(a.Port))
 	} else {
-		return fmt.Sprintf("%s:%v", ip[0].String(), a.Port)
+		return net.JoinHostPort(ip[0].String(), strconv.Itoa(a.Port))
 	}
 }
 